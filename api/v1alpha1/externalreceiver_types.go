@@ -0,0 +1,89 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ExternalEndpoint is a receiver outside of the cluster.
+// Exactly one of Address or Hostname should be set.
+type ExternalEndpoint struct {
+	// Address is the IP address of the receiver
+	Address string `json:"address,omitempty"`
+	// Hostname is a DNS name that is periodically resolved to the receiver addresses
+	Hostname string `json:"hostname,omitempty"`
+	// Port is the UDP port of the receiver
+	Port int32 `json:"port"`
+	// Weight is the relative load balancing weight of the receiver
+	Weight *int32 `json:"weight,omitempty"`
+}
+
+// ExternalReceiverSpec defines the external endpoints that receive traffic from a proxy
+type ExternalReceiverSpec struct {
+	// Proxy is the name of the quilkin proxy the endpoints are added to
+	Proxy string `json:"proxy"`
+	// Endpoints is the list of external receivers
+	Endpoints []ExternalEndpoint `json:"endpoints"`
+	// ResolveInterval is how often hostnames are resolved. Defaults to 30s.
+	ResolveInterval *metav1.Duration `json:"resolveInterval,omitempty"`
+	// LeaseDurationSeconds is how long the endpoints stay registered after RenewTime.
+	// If unset the endpoints never expire.
+	LeaseDurationSeconds *int32 `json:"leaseDurationSeconds,omitempty"`
+	// RenewTime is updated by external agents to renew their registration
+	RenewTime *metav1.MicroTime `json:"renewTime,omitempty"`
+}
+
+// ExternalReceiverStatus defines the observed state of ExternalReceiver
+type ExternalReceiverStatus struct {
+	// Proxy is the name of the proxy the endpoints are currently registered with
+	Proxy string `json:"proxy,omitempty"`
+	// Endpoints is the number of resolved endpoints currently registered with the proxy
+	Endpoints int `json:"endpoints"`
+	// Expired is true when the lease was not renewed in time and the endpoints were removed
+	Expired bool `json:"expired,omitempty"`
+	// LastResolveTime is the last time resolving changed the registered endpoints
+	LastResolveTime *metav1.Time `json:"lastResolveTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Proxy",type=string,JSONPath=`.spec.proxy`
+//+kubebuilder:printcolumn:name="Endpoints",type=integer,JSONPath=`.status.endpoints`
+//+kubebuilder:printcolumn:name="Expired",type=boolean,JSONPath=`.status.expired`
+
+// ExternalReceiver registers receivers outside of the cluster with a quilkin proxy
+type ExternalReceiver struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ExternalReceiverSpec   `json:"spec,omitempty"`
+	Status ExternalReceiverStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ExternalReceiverList contains a list of ExternalReceiver
+type ExternalReceiverList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ExternalReceiver `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ExternalReceiver{}, &ExternalReceiverList{})
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GatewaySpec configures a standalone quilkin Deployment and Service for a proxy
+type GatewaySpec struct {
+	// Replicas is the number of quilkin replicas. Defaults to 1.
+	Replicas *int32 `json:"replicas,omitempty"`
+	// Image is the quilkin image to run. Defaults to the image injected into senders.
+	Image string `json:"image,omitempty"`
+	// Version is the quilkin version of Image. Defaults to the version in its tag.
+	Version string `json:"version,omitempty"`
+	// Port is the UDP port clients send traffic to on the Service. Defaults to 7000.
+	Port int32 `json:"port,omitempty"`
+	// ServiceType is the type of the Service exposing the gateway. Defaults to ClusterIP.
+	ServiceType corev1.ServiceType `json:"serviceType,omitempty"`
+	// ServiceAnnotations are added to the Service, e.g. to configure a cloud load balancer
+	ServiceAnnotations map[string]string `json:"serviceAnnotations,omitempty"`
+	// Resources are the compute resources of the quilkin container
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+}
+
+// SidecarSpec configures the quilkin sidecars injected into senders of a proxy. Pod and namespace annotations
+// take precedence.
+type SidecarSpec struct {
+	// Port is the port the sidecar listens on. Defaults to the controller's --proxy-port.
+	Port int32 `json:"port,omitempty"`
+	// AdminPort is the admin port of the sidecar. Defaults to the controller's --admin-port.
+	AdminPort int32 `json:"adminPort,omitempty"`
+}
+
+// FirewallSpec restricts the receiver side proxies of a proxy to packets from its sender pods
+type FirewallSpec struct {
+	// AllowedCIDRs are source ranges allowed in addition to the addresses of the sender pods, e.g. of gateways
+	// and node proxies
+	AllowedCIDRs []string `json:"allowedCIDRs,omitempty"`
+}
+
+// CompressFilter compresses or decompresses packets passing through the proxy
+type CompressFilter struct {
+	// Mode is the compression algorithm. Only Snappy is supported.
+	Mode string `json:"mode,omitempty"`
+	// OnRead is the action applied to packets read from senders. One of Compress, Decompress or DoNothing.
+	OnRead string `json:"onRead,omitempty"`
+	// OnWrite is the action applied to packets written back to senders. One of Compress, Decompress or DoNothing.
+	OnWrite string `json:"onWrite,omitempty"`
+}
+
+// CaptureBytesFilter captures bytes from the start or end of packets, optionally removing them
+type CaptureBytesFilter struct {
+	// Strategy is where the bytes are captured from. One of Prefix or Suffix.
+	Strategy string `json:"strategy,omitempty"`
+	// Size is the number of bytes to capture
+	Size uint32 `json:"size"`
+	// MetadataKey is the key the captured bytes are stored under
+	MetadataKey string `json:"metadataKey,omitempty"`
+	// Remove removes the captured bytes from the packet
+	Remove bool `json:"remove,omitempty"`
+}
+
+// LocalRateLimitFilter caps the number of packets each proxy forwards per period, dropping the rest
+type LocalRateLimitFilter struct {
+	// MaxPackets is the number of packets forwarded per period
+	MaxPackets uint64 `json:"maxPackets"`
+	// Period is the period packets are counted over, at least 100ms. Defaults to 1s.
+	Period metav1.Duration `json:"period,omitempty"`
+}
+
+// Filter is a single quilkin filter. Exactly one field must be set.
+type Filter struct {
+	Compress       *CompressFilter       `json:"compress,omitempty"`
+	CaptureBytes   *CaptureBytesFilter   `json:"captureBytes,omitempty"`
+	LocalRateLimit *LocalRateLimitFilter `json:"localRateLimit,omitempty"`
+}
+
+// ProxySpec defines the desired state of Proxy
+type ProxySpec struct {
+	// Gateway runs the proxy as a controller managed Deployment instead of only as injected sidecars
+	Gateway *GatewaySpec `json:"gateway,omitempty"`
+	// Filters is the filter chain of the proxies senders and gateways use
+	Filters []Filter `json:"filters,omitempty"`
+	// ReceiverFilters is the filter chain of the receiver side proxies injected into receivers
+	// annotated with nfowler.dev/quilkin.receiver-proxy
+	ReceiverFilters []Filter `json:"receiverFilters,omitempty"`
+	// Sidecar configures the sidecars injected into senders of the proxy
+	Sidecar *SidecarSpec `json:"sidecar,omitempty"`
+	// Firewall restricts the receiver side proxies of the proxy to packets from its sender pods and the
+	// allowed CIDRs
+	Firewall *FirewallSpec `json:"firewall,omitempty"`
+}
+
+// ProxyStatus defines the observed state of Proxy
+type ProxyStatus struct {
+	// ReadyReplicas is the number of ready gateway replicas
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+	// Addresses are the addresses clients can reach the gateway on
+	Addresses []string `json:"addresses,omitempty"`
+	// Conflict names the Proxy in another namespace that already uses this name. The proxy is ignored until
+	// that one is deleted.
+	Conflict string `json:"conflict,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyReplicas`
+//+kubebuilder:printcolumn:name="Addresses",type=string,JSONPath=`.status.addresses`
+
+// Proxy is a named quilkin proxy. Its name is the node id the proxies use with the xDS server.
+type Proxy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ProxySpec   `json:"spec,omitempty"`
+	Status ProxyStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ProxyList contains a list of Proxy
+type ProxyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Proxy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Proxy{}, &ProxyList{})
+}
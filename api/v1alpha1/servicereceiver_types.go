@@ -0,0 +1,68 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// ServiceReceiverSpec defines the Service whose endpoints receive traffic from a proxy
+type ServiceReceiverSpec struct {
+	// Proxy is the name of the quilkin proxy the endpoints are added to
+	Proxy string `json:"proxy"`
+	// Service is the name of a Service in the same namespace as the ServiceReceiver
+	Service string `json:"service"`
+	// Port is the name or number of the UDP service port traffic is sent to
+	Port intstr.IntOrString `json:"port"`
+}
+
+// ServiceReceiverStatus defines the observed state of ServiceReceiver
+type ServiceReceiverStatus struct {
+	// Proxy is the name of the proxy the endpoints are currently mirrored into
+	Proxy string `json:"proxy,omitempty"`
+	// Endpoints is the number of endpoints currently mirrored into the proxy
+	Endpoints int `json:"endpoints"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Proxy",type=string,JSONPath=`.spec.proxy`
+//+kubebuilder:printcolumn:name="Service",type=string,JSONPath=`.spec.service`
+//+kubebuilder:printcolumn:name="Endpoints",type=integer,JSONPath=`.status.endpoints`
+
+// ServiceReceiver mirrors the EndpointSlices of a Service into the endpoints of a quilkin proxy
+type ServiceReceiver struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ServiceReceiverSpec   `json:"spec,omitempty"`
+	Status ServiceReceiverStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ServiceReceiverList contains a list of ServiceReceiver
+type ServiceReceiverList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ServiceReceiver `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ServiceReceiver{}, &ServiceReceiverList{})
+}
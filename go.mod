@@ -4,12 +4,15 @@ go 1.16
 
 require (
 	github.com/envoyproxy/go-control-plane v0.9.9
-	go.uber.org/zap v1.15.0
+	github.com/prometheus/client_golang v1.11.0
+	go.uber.org/zap v1.19.0
 	google.golang.org/grpc v1.36.0
-	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776
-	k8s.io/api v0.20.2
-	k8s.io/apimachinery v0.20.2
-	k8s.io/client-go v0.20.2
-	k8s.io/utils v0.0.0-20210111153108-fddb29f9d009
-	sigs.k8s.io/controller-runtime v0.8.3
+	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
+	k8s.io/api v0.21.14
+	k8s.io/apimachinery v0.21.14
+	k8s.io/client-go v0.21.14
+	k8s.io/utils v0.0.0-20211116205334-6203023598ed
+	sigs.k8s.io/controller-runtime v0.9.7
+	sigs.k8s.io/yaml v1.2.0
 )
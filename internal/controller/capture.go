@@ -0,0 +1,125 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/utils/net"
+)
+
+const (
+	// CaptureAnnotation lists the destination UDP ports whose outbound traffic is redirected into the quilkin
+	// sidecar, e.g. "7777,8000-8010". Senders don't need to be coded to send to the sidecar when set.
+	CaptureAnnotation = "nfowler.dev/quilkin.capture-ports"
+	// captureContainer is the name of the init container installing the redirect rules
+	captureContainer = "quilkin-capture"
+	// captureChain is the nat chain holding the redirect rules
+	captureChain = "QUILKIN_OUTPUT"
+)
+
+var (
+	// CaptureImage is the image of the init container installing the redirect rules. It must provide iptables.
+	CaptureImage = "k8s.gcr.io/build-image/debian-iptables:buster-v1.6.7"
+)
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	from int
+	to   int
+}
+
+// parseCapturePorts parses a comma separated list of ports and port ranges
+func parseCapturePorts(annotation string) ([]portRange, error) {
+	ranges := make([]portRange, 0)
+	for _, value := range strings.Split(annotation, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		bounds := strings.SplitN(value, "-", 2)
+		from, err := net.ParsePort(bounds[0], false)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid port %q", CaptureAnnotation, value)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = net.ParsePort(bounds[1], false); err != nil || to < from {
+				return nil, fmt.Errorf("%s: invalid port range %q", CaptureAnnotation, value)
+			}
+		}
+		ranges = append(ranges, portRange{from: from, to: to})
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("%s has no ports", CaptureAnnotation)
+	}
+	return ranges, nil
+}
+
+// captureRules returns the iptables commands redirecting outbound UDP traffic to the ports provided into the
+// quilkin proxy port. Traffic sent by quilkin itself, identified by its uid, and to localhost is left alone.
+func captureRules(ports []portRange, proxyPort int, uid int64) []string {
+	rules := []string{
+		"iptables -t nat -N " + captureChain,
+		fmt.Sprintf("iptables -t nat -A %s -m owner --uid-owner %d -j RETURN", captureChain, uid),
+		fmt.Sprintf("iptables -t nat -A %s -d 127.0.0.1/32 -j RETURN", captureChain),
+	}
+	for _, r := range ports {
+		dport := strconv.Itoa(r.from)
+		if r.to != r.from {
+			dport += ":" + strconv.Itoa(r.to)
+		}
+		rules = append(rules, fmt.Sprintf("iptables -t nat -A %s -p udp --dport %s -j REDIRECT --to-ports %d", captureChain, dport, proxyPort))
+	}
+	return append(rules, "iptables -t nat -A OUTPUT -p udp -j "+captureChain)
+}
+
+// makeCaptureContainer constructs the init container installing the rules provided
+func makeCaptureContainer(rules []string) v1.Container {
+	root := int64(0)
+	return v1.Container{
+		Name:    captureContainer,
+		Image:   CaptureImage,
+		Command: []string{"sh", "-c", "set -e\n" + strings.Join(rules, "\n")},
+		SecurityContext: &v1.SecurityContext{
+			RunAsUser:    &root,
+			Capabilities: &v1.Capabilities{Add: []v1.Capability{"NET_ADMIN", "NET_RAW"}, Drop: []v1.Capability{"ALL"}},
+		},
+	}
+}
+
+// addCapture adds the init container redirecting the ports in the capture annotation into the quilkin sidecar.
+// The sidecar is given a fixed uid if it has none so its own traffic can be excluded.
+func addCapture(pod *v1.Pod, sidecar *v1.Container, annotation string, proxyPort int) error {
+	ports, err := parseCapturePorts(annotation)
+	if err != nil {
+		return err
+	}
+	if sidecar.SecurityContext == nil {
+		sidecar.SecurityContext = &v1.SecurityContext{}
+	}
+	if sidecar.SecurityContext.RunAsUser == nil {
+		user := int64(sidecarUser)
+		sidecar.SecurityContext.RunAsUser = &user
+	}
+	rules := captureRules(ports, proxyPort, *sidecar.SecurityContext.RunAsUser)
+	pod.Spec.InitContainers = setInitContainer(pod.Spec.InitContainers, makeCaptureContainer(rules))
+	return nil
+}
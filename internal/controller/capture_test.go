@@ -0,0 +1,70 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCaptureRules(t *testing.T) {
+	t.Parallel()
+	ports, err := parseCapturePorts("7777, 8000-8010")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"iptables -t nat -N QUILKIN_OUTPUT",
+		"iptables -t nat -A QUILKIN_OUTPUT -m owner --uid-owner 65534 -j RETURN",
+		"iptables -t nat -A QUILKIN_OUTPUT -d 127.0.0.1/32 -j RETURN",
+		"iptables -t nat -A QUILKIN_OUTPUT -p udp --dport 7777 -j REDIRECT --to-ports 7000",
+		"iptables -t nat -A QUILKIN_OUTPUT -p udp --dport 8000:8010 -j REDIRECT --to-ports 7000",
+		"iptables -t nat -A OUTPUT -p udp -j QUILKIN_OUTPUT",
+	}
+	if got := captureRules(ports, 7000, 65534); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseCapturePortsInvalid(t *testing.T) {
+	t.Parallel()
+	for _, annotation := range []string{"", "game", "8010-8000", "70000"} {
+		if _, err := parseCapturePorts(annotation); err == nil {
+			t.Errorf("%q should be invalid", annotation)
+		}
+	}
+}
+
+func TestAddCaptureUsesSidecarUser(t *testing.T) {
+	t.Parallel()
+	user := int64(1000)
+	pod := &corev1.Pod{}
+	container := makeQuilkinContainer()
+	container.SecurityContext = &corev1.SecurityContext{RunAsUser: &user}
+	if err := addCapture(pod, &container, "7777", 7000); err != nil {
+		t.Fatal(err)
+	}
+	if len(pod.Spec.InitContainers) != 1 || pod.Spec.InitContainers[0].Name != captureContainer {
+		t.Fatal("capture init container should be added")
+	}
+	if rules := pod.Spec.InitContainers[0].Command[2]; rules != "set -e\n"+strings.Join(captureRules([]portRange{{7777, 7777}}, 7000, 1000), "\n") {
+		t.Errorf("rules should exclude the sidecar user: %s", rules)
+	}
+}
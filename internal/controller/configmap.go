@@ -0,0 +1,371 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	gonet "net"
+	"strconv"
+
+	"github.com/nfowl/quilkin-controller/internal/quilkin"
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/net"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// sidecarConfigComponent is the ComponentLabel value of the config maps of injected quilkin containers
+	sidecarConfigComponent = "sidecar-config"
+	// senderConfigVolume is the volume holding the config of a sender sidecar
+	senderConfigVolume = "quilkin-config"
+	// receiverProxyConfigVolume is the volume holding the config of a receiver proxy
+	receiverProxyConfigVolume = receiverProxyContainer + "-config"
+	// quilkinConfigKey is the config map key holding the quilkin config
+	quilkinConfigKey = "quilkin.yaml"
+	// InjectedConfigsAnnotation records the quilkin config of each config map a pod mounts as of its injection
+	InjectedConfigsAnnotation = "nfowler.dev/quilkin.injected-configs"
+)
+
+// injectedConfig is the quilkin config of a config map recorded in InjectedConfigsAnnotation
+type injectedConfig struct {
+	Proxy     string `json:"proxy"`
+	ID        string `json:"id"`
+	Port      int    `json:"port"`
+	AdminPort int    `json:"adminPort"`
+	Version   string `json:"version"`
+}
+
+// config returns the quilkin config recorded
+func (i injectedConfig) config() quilkin.QuilkinConfig {
+	conf := quilkin.NewQuilkinConfig(i.ID)
+	conf.Proxy.Port = i.Port
+	conf.Admin.Address = "[::]:" + strconv.Itoa(i.AdminPort)
+	return conf
+}
+
+// setInjectedConfigs records the config of each config map the injected pod mounts in InjectedConfigsAnnotation.
+// Config maps are generated from it so they match the pod even once its settings resolve differently,
+// e.g. after the namespace defaults changed.
+func setInjectedConfigs(pod *corev1.Pod, settings InjectionSettings) error {
+	version, err := settings.quilkinVersion()
+	if err != nil {
+		return err
+	}
+	configs := make(map[string]injectedConfig)
+	for _, volume := range pod.Spec.Volumes {
+		if volume.ConfigMap == nil {
+			continue
+		}
+		proxyName, conf, ok := podSidecarConfig(pod, settings, volume.Name, volume.ConfigMap.Name)
+		if !ok {
+			continue
+		}
+		configs[volume.ConfigMap.Name] = injectedConfig{
+			Proxy:     proxyName,
+			ID:        conf.Proxy.Id,
+			Port:      conf.Proxy.Port,
+			AdminPort: adminPort(conf),
+			Version:   version,
+		}
+	}
+	if len(configs) == 0 {
+		delete(pod.Annotations, InjectedConfigsAnnotation)
+		return nil
+	}
+	value, err := json.Marshal(configs)
+	if err != nil {
+		return err
+	}
+	metav1.SetMetaDataAnnotation(&pod.ObjectMeta, InjectedConfigsAnnotation, string(value))
+	return nil
+}
+
+// injectedConfigs returns the configs recorded in the InjectedConfigsAnnotation of the pod, none if it has no valid one
+func injectedConfigs(pod *corev1.Pod) map[string]injectedConfig {
+	configs := make(map[string]injectedConfig)
+	if value, ok := pod.Annotations[InjectedConfigsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &configs); err != nil {
+			return nil
+		}
+	}
+	return configs
+}
+
+// adminPort returns the port of the admin address of a quilkin config
+func adminPort(conf quilkin.QuilkinConfig) int {
+	_, port, err := gonet.SplitHostPort(conf.Admin.Address)
+	if err != nil {
+		return 0
+	}
+	value, _ := strconv.Atoi(port)
+	return value
+}
+
+// ConfigMapReconciler manages the config maps mounted by injected quilkin containers. Config maps are created
+// once a pod mounts them, corrected when they drift from the config generated for their pods and deleted
+// once no pod mounts them.
+type ConfigMapReconciler struct {
+	client client.Client
+	logger *zap.SugaredLogger
+}
+
+// NewConfigMapReconciler constructs a new ConfigMapReconciler struct from the passed arguments
+func NewConfigMapReconciler(c client.Client, l *zap.SugaredLogger) *ConfigMapReconciler {
+	return &ConfigMapReconciler{
+		client: c,
+		logger: l,
+	}
+}
+
+// SetupWithManager registers the reconciler and the watches on the pods mounting the config maps with the manager
+func (r *ConfigMapReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	managed := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return obj.GetLabels()[ManagedByLabel] == ManagedByValue
+	})
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("sidecar-configmap").
+		For(&corev1.ConfigMap{}, builder.WithPredicates(managed)).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, handler.EnqueueRequestsFromMapFunc(podConfigMaps)).
+		Complete(r)
+}
+
+// podConfigMaps maps a pod to the sidecar config maps it mounts
+func podConfigMaps(obj client.Object) []reconcile.Request {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, 2)
+	for _, name := range sidecarConfigMapNames(pod) {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: pod.Namespace, Name: name}})
+	}
+	return requests
+}
+
+// Reconcile ensures the config map matches the config generated for the pods mounting it
+func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	cm := &corev1.ConfigMap{}
+	err := r.client.Get(ctx, req.NamespacedName, cm)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+	exists := err == nil
+	if exists && !isSidecarConfigMap(cm) {
+		return reconcile.Result{}, nil
+	}
+
+	pods := &corev1.PodList{}
+	if err := r.client.List(ctx, pods, client.InNamespace(req.Namespace)); err != nil {
+		return reconcile.Result{}, err
+	}
+	users := make([]*corev1.Pod, 0)
+	for i := range pods.Items {
+		if containsString(sidecarConfigMapNames(&pods.Items[i]), req.Name) {
+			users = append(users, &pods.Items[i])
+		}
+	}
+
+	if len(users) == 0 {
+		if !exists {
+			return reconcile.Result{}, nil
+		}
+		r.logger.Infow("Deleting unused quilkin config map", "namespace", req.Namespace, "name", req.Name)
+		return reconcile.Result{}, client.IgnoreNotFound(r.client.Delete(ctx, cm))
+	}
+
+	desired, err := r.desiredConfigMap(ctx, req, users)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if desired == nil {
+		r.logger.Warnw("No pod mounting the quilkin config map records or resolves its config, leaving it alone", "namespace", req.Namespace, "name", req.Name)
+		return reconcile.Result{}, nil
+	}
+
+	if !exists {
+		r.logger.Infow("Creating quilkin config map", "namespace", req.Namespace, "name", req.Name)
+		if err := r.client.Create(ctx, desired); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				// Created since the cache was read, check it against the desired config once it is
+				return reconcile.Result{Requeue: true}, nil
+			}
+			return reconcile.Result{}, err
+		}
+		return reconcile.Result{}, nil
+	}
+
+	if equality.Semantic.DeepEqual(cm.Data, desired.Data) && hasLabels(cm.Labels, desired.Labels) {
+		return reconcile.Result{}, nil
+	}
+	r.logger.Infow("Correcting quilkin config map", "namespace", req.Namespace, "name", req.Name)
+	cm.Data = desired.Data
+	for key, value := range desired.Labels {
+		metav1.SetMetaDataLabel(&cm.ObjectMeta, key, value)
+	}
+	if err := r.client.Update(ctx, cm); err != nil {
+		if apierrors.IsConflict(err) {
+			return reconcile.Result{Requeue: true}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{}, nil
+}
+
+// desiredConfigMap returns the config map generated for the pods mounting it. The config the first pod recorded
+// at injection is used. Pods injected before the config was recorded fall back to their current settings,
+// nil is returned when those no longer resolve to the config map for every pod.
+func (r *ConfigMapReconciler) desiredConfigMap(ctx context.Context, req reconcile.Request, pods []*corev1.Pod) (*corev1.ConfigMap, error) {
+	for _, pod := range pods {
+		if config, ok := injectedConfigs(pod)[req.Name]; ok {
+			return makeSidecarConfigMap(req.Namespace, req.Name, config.Proxy, config.config(), config.Version)
+		}
+	}
+
+	ns := &corev1.Namespace{}
+	if err := r.client.Get(ctx, client.ObjectKey{Name: req.Namespace}, ns); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		ns = nil
+	}
+	for _, pod := range pods {
+		settings, err := loadSettings(ctx, r.client, pod, ns)
+		if err != nil {
+			r.logger.Warnw("Invalid injection settings", "pod", pod.Name, "namespace", pod.Namespace, "error", err.Error())
+			continue
+		}
+		proxyName, conf, ok := podSidecarConfig(pod, settings, configVolume(pod, req.Name), req.Name)
+		if !ok {
+			continue
+		}
+		version, err := settings.quilkinVersion()
+		if err != nil {
+			r.logger.Warnw("Unsupported quilkin version", "pod", pod.Name, "namespace", pod.Namespace, "error", err.Error())
+			continue
+		}
+		return makeSidecarConfigMap(req.Namespace, req.Name, proxyName, conf, version)
+	}
+	return nil, nil
+}
+
+// configVolume returns the name of the volume of the pod mounting the config map provided
+func configVolume(pod *corev1.Pod, configMap string) string {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.ConfigMap != nil && volume.ConfigMap.Name == configMap {
+			return volume.Name
+		}
+	}
+	return ""
+}
+
+// podSidecarConfig returns the proxy and config generated for the config volume of the pod provided.
+// False is returned when the volume isn't a sidecar config volume or the pod's settings resolve to
+// a config map other than the one it mounts.
+func podSidecarConfig(pod *corev1.Pod, settings InjectionSettings, volume string, configMap string) (string, quilkin.QuilkinConfig, bool) {
+	for _, sidecar := range settings.Sidecars {
+		if sidecar.volume == volume && sidecar.configName() == configMap {
+			return sidecar.proxy, sidecar.config(), true
+		}
+	}
+	if volume == receiverProxyConfigVolume {
+		proxyName, port, err := parseReceiveAnnotation(pod.Annotations[ReceiverAnnotation])
+		if err != nil {
+			return "", quilkin.QuilkinConfig{}, false
+		}
+		target, err := net.ParsePort(pod.Annotations[ReceiverProxyAnnotation], false)
+		if err != nil {
+			return "", quilkin.QuilkinConfig{}, false
+		}
+		if receiverProxyConfigName(proxyName, target) == configMap {
+			return proxyName, receiverProxyConfig(proxyName, port, target), true
+		}
+	}
+	return "", quilkin.QuilkinConfig{}, false
+}
+
+// receiverProxyConfig returns the quilkin config of a receiver proxy listening on the port provided
+// and forwarding to the target port
+func receiverProxyConfig(proxyName string, port int, target int) quilkin.QuilkinConfig {
+	conf := quilkin.NewQuilkinConfig(store.ReceiverProxyID(proxyName, target))
+	conf.Proxy.Port = port
+	conf.Admin.Address = "[::]:" + strconv.Itoa(receiverAdminPort)
+	return conf
+}
+
+// makeSidecarConfigMap constructs the config map holding the quilkin config provided rendered for a quilkin version
+func makeSidecarConfigMap(namespace string, name string, proxyName string, config quilkin.QuilkinConfig, version string) (*corev1.ConfigMap, error) {
+	conf, err := quilkin.Render(config, version)
+	if err != nil {
+		return nil, err
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels: map[string]string{
+				ManagedByLabel: ManagedByValue,
+				ComponentLabel: sidecarConfigComponent,
+				ProxyLabel:     proxyName,
+			},
+		},
+		Data: map[string]string{quilkinConfigKey: string(conf)},
+	}, nil
+}
+
+// isSidecarConfigMap returns whether the config map is a sidecar config map managed by the controller.
+// Config maps created by older controllers carry no component label.
+func isSidecarConfigMap(cm *corev1.ConfigMap) bool {
+	if cm.Labels[ManagedByLabel] != ManagedByValue || len(cm.OwnerReferences) != 0 {
+		return false
+	}
+	component, ok := cm.Labels[ComponentLabel]
+	return !ok || component == sidecarConfigComponent
+}
+
+// sidecarConfigMapNames returns the names of the sidecar config maps mounted by the pod
+func sidecarConfigMapNames(pod *corev1.Pod) []string {
+	names := make([]string, 0, 2)
+	for _, volume := range pod.Spec.Volumes {
+		if (isSenderConfigVolume(pod, volume.Name) || volume.Name == receiverProxyConfigVolume) && volume.ConfigMap != nil {
+			names = append(names, volume.ConfigMap.Name)
+		}
+	}
+	return names
+}
+
+// hasLabels returns whether the labels contain every label expected
+func hasLabels(labels map[string]string, expected map[string]string) bool {
+	for key, value := range expected {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
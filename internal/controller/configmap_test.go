@@ -0,0 +1,138 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nfowl/quilkin-controller/api/v1alpha1"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func senderPod(name string, configMap string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "games", Name: name, Annotations: map[string]string{SenderAnnotation: "server"}},
+		Spec: corev1.PodSpec{Volumes: []corev1.Volume{{
+			Name:         senderConfigVolume,
+			VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: configMap}}},
+		}}},
+	}
+}
+
+func TestConfigMapReconcilerLifecycle(t *testing.T) {
+	pod := senderPod("client", "quilkin-server")
+	c := newFakeClient(pod)
+	r := NewConfigMapReconciler(c, zap.NewNop().Sugar())
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "games", Name: "quilkin-server"}}
+	ctx := context.Background()
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	cm := &corev1.ConfigMap{}
+	if err := c.Get(ctx, req.NamespacedName, cm); err != nil {
+		t.Fatalf("config map should be created: %v", err)
+	}
+	expected := cm.Data[quilkinConfigKey]
+	if cm.Labels[ComponentLabel] != sidecarConfigComponent || cm.Labels[ProxyLabel] != "server" {
+		t.Errorf("unexpected labels %v", cm.Labels)
+	}
+
+	cm.Data[quilkinConfigKey] = "edited"
+	if err := c.Update(ctx, cm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, req.NamespacedName, cm); err != nil || cm.Data[quilkinConfigKey] != expected {
+		t.Errorf("drift should be corrected, got %q", cm.Data[quilkinConfigKey])
+	}
+
+	if err := c.Delete(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, req.NamespacedName, cm); !apierrors.IsNotFound(err) {
+		t.Errorf("unused config map should be deleted, got %v", err)
+	}
+}
+
+func TestConfigMapReconcilerUsesInjectedConfig(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "games"}}
+	proxy := &v1alpha1.Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "server", Namespace: "games"},
+		Spec:       v1alpha1.ProxySpec{Sidecar: &v1alpha1.SidecarSpec{Port: 7100}},
+	}
+	c := newFakeClient(ns, proxy)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: "games", Annotations: map[string]string{SenderAnnotation: "server"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "game", Image: "game"}}},
+	}
+	ctx := context.Background()
+	if err := NewQuilkinAnnotationReader(c, zap.NewNop().Sugar(), nil).injectPod(ctx, ns, pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	// The pod's settings no longer resolve to the config map it mounts once the proxy port changes
+	proxy.Spec.Sidecar.Port = 7200
+	if err := c.Update(ctx, proxy); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewConfigMapReconciler(c, zap.NewNop().Sugar())
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "games", Name: "quilkin-server-7100-9091"}}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	cm := &corev1.ConfigMap{}
+	if err := c.Get(ctx, req.NamespacedName, cm); err != nil {
+		t.Fatalf("config map should be created from the injected config: %v", err)
+	}
+	if !strings.Contains(cm.Data[quilkinConfigKey], "port: 7100") {
+		t.Errorf("expected the injected port in config:\n%s", cm.Data[quilkinConfigKey])
+	}
+}
+
+func TestConfigMapReconcilerIgnoresOtherConfigMaps(t *testing.T) {
+	ctx := context.Background()
+	for _, cm := range []*corev1.ConfigMap{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "games", Name: "quilkin-server"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "games", Name: NodeProxyName, Labels: map[string]string{ManagedByLabel: ManagedByValue, ComponentLabel: nodeProxyComponent}}},
+	} {
+		c := newFakeClient(cm)
+		r := NewConfigMapReconciler(c, zap.NewNop().Sugar())
+		if _, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(cm)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(cm), &corev1.ConfigMap{}); err != nil {
+			t.Errorf("%s should be left alone: %v", cm.Name, err)
+		}
+	}
+}
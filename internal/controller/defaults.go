@@ -0,0 +1,402 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nfowl/quilkin-controller/api/v1alpha1"
+	"github.com/nfowl/quilkin-controller/internal/quilkin"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/utils/net"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// Annotations customising injection. Each can be set on a namespace to default every pod in it, or on a pod
+// to override the namespace. Pod annotations take precedence over namespace annotations, which take
+// precedence over the controller flags.
+const (
+	// ImageAnnotation is the quilkin image injected
+	ImageAnnotation = "nfowler.dev/quilkin.image"
+	// VersionAnnotation is the quilkin version of the image set at the same level, for tags that aren't versions
+	VersionAnnotation = "nfowler.dev/quilkin.version"
+	// ProxyPortAnnotation is the port the sender sidecar listens on
+	ProxyPortAnnotation = "nfowler.dev/quilkin.proxy-port"
+	// AdminPortAnnotation is the admin port of the sender sidecar
+	AdminPortAnnotation = "nfowler.dev/quilkin.admin-port"
+	// PortConflictAnnotation is what happens when a container of the pod declares a port of the sender sidecar,
+	// either PortConflictReject or PortConflictAuto
+	PortConflictAnnotation = "nfowler.dev/quilkin.port-conflict"
+	// ResourcesAnnotation holds the compute resources of the injected containers as YAML or JSON.
+	// It takes precedence over sidecar templates.
+	ResourcesAnnotation = "nfowler.dev/quilkin.resources"
+	// DrainPeriodAnnotation is how long a terminating receiver keeps being served to senders, e.g. "30s"
+	DrainPeriodAnnotation = "nfowler.dev/quilkin.drain-period"
+	// FiltersAnnotation is a namespace annotation holding the default filters of the Proxies in it as YAML or JSON
+	FiltersAnnotation = "nfowler.dev/quilkin.filters"
+	// ReceiverFiltersAnnotation is a namespace annotation holding the default receiver filters of the Proxies in it
+	ReceiverFiltersAnnotation = "nfowler.dev/quilkin.receiver-filters"
+	// ConfigAnnotation is a pod annotation holding the config of its sender sidecar as YAML or JSON. Its ports
+	// take precedence over the port annotations and its filters replace the filter chain of the proxy.
+	ConfigAnnotation = "nfowler.dev/quilkin.config"
+)
+
+const (
+	// PortConflictReject denies admission of pods declaring a port of their sender sidecar
+	PortConflictReject = "reject"
+	// PortConflictAuto moves the sender sidecar to the next free ports
+	PortConflictAuto = "auto"
+)
+
+var (
+	// DefaultProxyPort is the port sender sidecars listen on when not set by annotations
+	DefaultProxyPort = quilkinProxyPort
+	// DefaultAdminPort is the admin port of sender sidecars when not set by annotations
+	DefaultAdminPort = quilkinAdminPort
+	// DefaultDrainPeriod is the drain period of receivers when not set by annotations
+	DefaultDrainPeriod time.Duration
+	// DefaultPortConflict is what happens on sidecar port conflicts when not set by annotations
+	DefaultPortConflict = PortConflictReject
+)
+
+// InjectionSettings are the settings of a pod resolved from its annotations, its namespace and the flags
+type InjectionSettings struct {
+	Image        string
+	Version      string
+	ProxyPort    int
+	AdminPort    int
+	PortConflict string
+	Resources    *corev1.ResourceRequirements
+	DrainPeriod  time.Duration
+	Config       *quilkin.SidecarConfig
+	// Sidecars are the sidecars of a sender, one per proxy, in the order of its annotation
+	Sidecars []senderSidecar
+}
+
+// loadSettings resolves the injection settings of the pod, reading the Proxies it sends to that exist.
+// The namespace may be nil.
+func loadSettings(ctx context.Context, c client.Client, pod *corev1.Pod, ns *corev1.Namespace) (InjectionSettings, error) {
+	proxies := make(map[string]*v1alpha1.Proxy)
+	for _, name := range senderProxies(pod) {
+		proxy := &v1alpha1.Proxy{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: name}, proxy); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return InjectionSettings{}, fmt.Errorf("getting proxy %s: %w", name, err)
+			}
+			continue
+		}
+		proxies[name] = proxy
+	}
+	return resolveSettings(pod, ns, proxies)
+}
+
+// resolveSettings resolves the injection settings of the pod. The namespace may be nil and proxies holds the
+// Proxies the pod sends to that exist.
+func resolveSettings(pod *corev1.Pod, ns *corev1.Namespace, proxies map[string]*v1alpha1.Proxy) (InjectionSettings, error) {
+	settings := InjectionSettings{
+		Image:        QuilkinImage,
+		Version:      QuilkinVersion,
+		ProxyPort:    DefaultProxyPort,
+		AdminPort:    DefaultAdminPort,
+		PortConflict: DefaultPortConflict,
+		DrainPeriod:  DefaultDrainPeriod,
+	}
+	var names []string
+	if value, ok := pod.Annotations[SenderAnnotation]; ok {
+		var err error
+		if names, err = parseSenderAnnotation(value); err != nil {
+			return settings, err
+		}
+	}
+	if ns != nil {
+		if err := settings.apply(ns.Annotations); err != nil {
+			return settings, fmt.Errorf("namespace %s: %w", ns.Name, err)
+		}
+	}
+	if len(names) > 0 {
+		if proxy, ok := proxies[names[0]]; ok && proxy.Spec.Sidecar != nil {
+			if err := settings.applySidecarSpec(proxy.Spec.Sidecar); err != nil {
+				return settings, fmt.Errorf("proxy %s: %w", proxy.Name, err)
+			}
+		}
+	}
+	if err := settings.apply(pod.Annotations); err != nil {
+		return settings, fmt.Errorf("pod: %w", err)
+	}
+	if value, ok := pod.Annotations[ConfigAnnotation]; ok {
+		config, err := quilkin.ParseSidecarConfig(value)
+		if err != nil {
+			return settings, fmt.Errorf("pod: %s: %w", ConfigAnnotation, err)
+		}
+		settings.Config = config
+		if config.Port != 0 {
+			settings.ProxyPort = config.Port
+		}
+		if config.AdminPort != 0 {
+			settings.AdminPort = config.AdminPort
+		}
+	}
+	if settings.ProxyPort == settings.AdminPort {
+		return settings, fmt.Errorf("%s and %s are both %d", ProxyPortAnnotation, AdminPortAnnotation, settings.ProxyPort)
+	}
+	if len(names) > 0 && ProxyMode != NodeProxyMode {
+		if err := settings.resolveSidecars(pod, names, proxies); err != nil {
+			return settings, err
+		}
+	}
+	return settings, nil
+}
+
+// applySidecarSpec overrides the sidecar ports with any set by a Proxy
+func (s *InjectionSettings) applySidecarSpec(spec *v1alpha1.SidecarSpec) error {
+	for _, port := range []int32{spec.Port, spec.AdminPort} {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid sidecar port %d", port)
+		}
+	}
+	if spec.Port != 0 {
+		s.ProxyPort = int(spec.Port)
+	}
+	if spec.AdminPort != 0 {
+		s.AdminPort = int(spec.AdminPort)
+	}
+	return nil
+}
+
+// resolveSidecars allocates the ports of a sidecar per proxy of a sender. The first proxy uses the resolved
+// ports and the config annotation. Further proxies use the ports of their Proxy, or those of the first
+// proxy, moved to the next free ports.
+func (s *InjectionSettings) resolveSidecars(pod *corev1.Pod, names []string, proxies map[string]*v1alpha1.Proxy) error {
+	declared := declaredPorts(pod)
+	taken := make(map[int]bool)
+	s.Sidecars = make([]senderSidecar, 0, len(names))
+	for i, name := range names {
+		container, volume := sidecarNames(i)
+		sidecar := senderSidecar{proxy: name, container: container, volume: volume, proxyPort: s.ProxyPort, adminPort: s.AdminPort}
+		if i == 0 {
+			sidecar.variantKey = s.variantKey()
+		} else if proxy, ok := proxies[name]; ok && proxy.Spec.Sidecar != nil {
+			ports := InjectionSettings{ProxyPort: sidecar.proxyPort, AdminPort: sidecar.adminPort}
+			if err := ports.applySidecarSpec(proxy.Spec.Sidecar); err != nil {
+				return fmt.Errorf("proxy %s: %w", name, err)
+			}
+			sidecar.proxyPort, sidecar.adminPort = ports.ProxyPort, ports.AdminPort
+		}
+		var err error
+		if sidecar.proxyPort, err = s.allocatePort(sidecar.proxyPort, sidecar.adminPort, declared, taken); err != nil {
+			return fmt.Errorf("proxy %s: %w", name, err)
+		}
+		taken[sidecar.proxyPort] = true
+		if sidecar.adminPort, err = s.allocatePort(sidecar.adminPort, 0, declared, taken); err != nil {
+			return fmt.Errorf("proxy %s: %w", name, err)
+		}
+		taken[sidecar.adminPort] = true
+		s.Sidecars = append(s.Sidecars, sidecar)
+	}
+	s.ProxyPort, s.AdminPort = s.Sidecars[0].proxyPort, s.Sidecars[0].adminPort
+	return nil
+}
+
+// allocatePort returns the port requested unless a container of the pod declares it, regardless of protocol,
+// or another sidecar of the pod takes it. Ports declared by the pod are rejected unless the port conflict
+// policy is auto, then the next free port other than the one to avoid is returned. The result only depends
+// on the pod spec so it is the same whenever the settings of a pod are resolved.
+func (s *InjectionSettings) allocatePort(port int, avoid int, declared map[int]string, taken map[int]bool) (int, error) {
+	container, conflict := declared[port]
+	if !conflict && !taken[port] {
+		return port, nil
+	}
+	if conflict && s.PortConflict != PortConflictAuto {
+		return 0, fmt.Errorf("sidecar port %d is already declared by container %s, choose another port or set %s to %s",
+			port, container, PortConflictAnnotation, PortConflictAuto)
+	}
+	for free := port + 1; free <= 65535; free++ {
+		if _, ok := declared[free]; !ok && !taken[free] && free != avoid {
+			return free, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port above %d for the sidecar", port)
+}
+
+// declaredPorts returns the ports declared by the containers of the pod, excluding injected containers,
+// and the ports of its receiver proxy, mapped to the container using them
+func declaredPorts(pod *corev1.Pod) map[int]string {
+	used := make(map[int]string)
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			if isInjectedContainer(pod, c.Name) {
+				continue
+			}
+			for _, port := range c.Ports {
+				used[int(port.ContainerPort)] = c.Name
+			}
+		}
+	}
+	if _, ok := pod.Annotations[ReceiverProxyAnnotation]; ok {
+		used[receiverAdminPort] = receiverProxyContainer
+		if _, port, err := parseReceiveAnnotation(pod.Annotations[ReceiverAnnotation]); err == nil {
+			used[port] = receiverProxyContainer
+		}
+	}
+	return used
+}
+
+// isInjectedContainer returns whether a container of the pod with the name provided is injected by the webhook
+func isInjectedContainer(pod *corev1.Pod, name string) bool {
+	return isSidecarContainer(pod, name) || name == captureContainer
+}
+
+// isSidecarContainer returns whether a container of the pod with the name provided is a quilkin sidecar
+func isSidecarContainer(pod *corev1.Pod, name string) bool {
+	if name == senderContainer || name == receiverProxyContainer {
+		return true
+	}
+	_, ok := extraSidecarIndex(pod, name, senderContainer)
+	return ok
+}
+
+// apply overrides the settings with any set in the annotations provided
+func (s *InjectionSettings) apply(annotations map[string]string) error {
+	if value, ok := annotations[ImageAnnotation]; ok && value != "" {
+		s.Image = value
+		// A version set for another image doesn't apply to this one
+		s.Version = ""
+	}
+	if value, ok := annotations[VersionAnnotation]; ok && value != "" {
+		s.Version = value
+	}
+	if value, ok := annotations[ProxyPortAnnotation]; ok {
+		port, err := net.ParsePort(value, false)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ProxyPortAnnotation, err)
+		}
+		s.ProxyPort = port
+	}
+	if value, ok := annotations[AdminPortAnnotation]; ok {
+		port, err := net.ParsePort(value, false)
+		if err != nil {
+			return fmt.Errorf("%s: %w", AdminPortAnnotation, err)
+		}
+		s.AdminPort = port
+	}
+	if value, ok := annotations[PortConflictAnnotation]; ok {
+		if value != PortConflictReject && value != PortConflictAuto {
+			return fmt.Errorf("%s must be %s or %s", PortConflictAnnotation, PortConflictReject, PortConflictAuto)
+		}
+		s.PortConflict = value
+	}
+	if value, ok := annotations[ResourcesAnnotation]; ok {
+		resources := &corev1.ResourceRequirements{}
+		if err := yaml.UnmarshalStrict([]byte(value), resources); err != nil {
+			return fmt.Errorf("%s: %w", ResourcesAnnotation, err)
+		}
+		s.Resources = resources
+	}
+	if value, ok := annotations[DrainPeriodAnnotation]; ok {
+		period, err := time.ParseDuration(value)
+		if err != nil || period < 0 {
+			return fmt.Errorf("%s: invalid duration %q", DrainPeriodAnnotation, value)
+		}
+		s.DrainPeriod = period
+	}
+	return nil
+}
+
+// quilkinVersion returns the quilkin version of the injected image, or an error if configs can't be
+// generated for it
+func (s *InjectionSettings) quilkinVersion() (string, error) {
+	return checkQuilkinVersion(s.Image, s.Version)
+}
+
+// DefaultQuilkinVersion returns the quilkin version of the image injected unless set by annotations, or an
+// error if configs can't be generated for it
+func DefaultQuilkinVersion() (string, error) {
+	return checkQuilkinVersion(QuilkinImage, QuilkinVersion)
+}
+
+// checkQuilkinVersion returns the version provided, or the version in the image tag when empty, if configs can
+// be generated for it
+func checkQuilkinVersion(image string, version string) (string, error) {
+	if version == "" {
+		var err error
+		if version, err = quilkin.ImageVersion(image); err != nil {
+			return "", err
+		}
+	}
+	if _, err := quilkin.GeneratorFor(version); err != nil {
+		return "", fmt.Errorf("image %s: %w", image, err)
+	}
+	return version, nil
+}
+
+// applyContainer sets the image and, if the admin port is provided, the admin port of a quilkin container.
+// Resources are applied separately as they take precedence over sidecar templates.
+func (s *InjectionSettings) applyContainer(container *corev1.Container, adminPort int) {
+	container.Image = s.Image
+	if adminPort == 0 {
+		return
+	}
+	container.ReadinessProbe = makeAdminProbe(adminPort)
+	for i := range container.Ports {
+		if container.Ports[i].Name == "http-admin" {
+			container.Ports[i].ContainerPort = int32(adminPort)
+		}
+	}
+}
+
+// applyDrainPeriod makes sure the pod's termination grace period covers the drain period
+func (s *InjectionSettings) applyDrainPeriod(pod *corev1.Pod) {
+	seconds := int64((s.DrainPeriod + time.Second - 1) / time.Second)
+	if seconds == 0 {
+		return
+	}
+	grace := int64(corev1.DefaultTerminationGracePeriodSeconds)
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		grace = *pod.Spec.TerminationGracePeriodSeconds
+	}
+	if grace < seconds {
+		pod.Spec.TerminationGracePeriodSeconds = &seconds
+	}
+}
+
+// variantKey returns the key of the sidecar's own filter chain, or an empty string when it uses the chain of
+// its proxy
+func (s *InjectionSettings) variantKey() string {
+	if s.Config == nil {
+		return ""
+	}
+	return s.Config.VariantKey()
+}
+
+// namespaceFilters returns the default filter chains set by annotations on the namespace
+func namespaceFilters(ns *corev1.Namespace) (filters []v1alpha1.Filter, receiverFilters []v1alpha1.Filter, err error) {
+	if value, ok := ns.Annotations[FiltersAnnotation]; ok {
+		if err := yaml.UnmarshalStrict([]byte(value), &filters); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", FiltersAnnotation, err)
+		}
+	}
+	if value, ok := ns.Annotations[ReceiverFiltersAnnotation]; ok {
+		if err := yaml.UnmarshalStrict([]byte(value), &receiverFilters); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", ReceiverFiltersAnnotation, err)
+		}
+	}
+	return filters, receiverFilters, nil
+}
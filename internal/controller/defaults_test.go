@@ -0,0 +1,212 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nfowl/quilkin-controller/api/v1alpha1"
+	"github.com/nfowl/quilkin-controller/internal/quilkin"
+	"github.com/nfowl/quilkin-controller/internal/store"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestResolveSettingsPrecedence(t *testing.T) {
+	t.Parallel()
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "games", Annotations: map[string]string{
+		ImageAnnotation:       "quilkin:ns",
+		VersionAnnotation:     "0.2.0",
+		ProxyPortAnnotation:   "7100",
+		DrainPeriodAnnotation: "30s",
+	}}}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		SenderAnnotation:    "game",
+		ImageAnnotation:     "quilkin:pod",
+		ResourcesAnnotation: `{"limits": {"memory": "64Mi"}}`,
+	}}}
+	settings, err := resolveSettings(pod, ns, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Image != "quilkin:pod" {
+		t.Error("pod annotations should override the namespace")
+	}
+	if _, err := settings.quilkinVersion(); err == nil {
+		t.Error("the namespace version shouldn't apply to the pod image")
+	}
+	if settings.ProxyPort != 7100 || settings.DrainPeriod != 30*time.Second {
+		t.Error("namespace annotations should override the flags")
+	}
+	if settings.AdminPort != DefaultAdminPort {
+		t.Error("unset settings should use the flags")
+	}
+	if settings.Resources.Limits.Memory().String() != "64Mi" {
+		t.Error("resources should be parsed")
+	}
+	if settings.Sidecars[0].configName() != "quilkin-game-7100-9091" {
+		t.Error("non default ports need their own config map")
+	}
+
+	pod.Annotations[AdminPortAnnotation] = "7100"
+	if _, err := resolveSettings(pod, ns, nil); err == nil {
+		t.Error("matching proxy and admin ports should be rejected")
+	}
+}
+
+func TestResolveSettingsConfigAnnotation(t *testing.T) {
+	t.Parallel()
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		SenderAnnotation:    "game",
+		ProxyPortAnnotation: "7100",
+		ConfigAnnotation:    `{"port": 7200, "filters": [{"compress": {"onRead": "Compress", "onWrite": "Decompress"}}]}`,
+	}}}
+	settings, err := resolveSettings(pod, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.ProxyPort != 7200 {
+		t.Error("the config annotation should override the port annotations")
+	}
+	key := settings.variantKey()
+	if key == "" || settings.Sidecars[0].nodeID() != store.SenderVariantID("game", key) {
+		t.Error("sidecars with their own filters need their own node id")
+	}
+	if name := settings.Sidecars[0].configName(); name != "quilkin-game-"+key+"-7200-9091" {
+		t.Errorf("unexpected config map name %s", name)
+	}
+
+	pod.Annotations[ConfigAnnotation] = `{"filters": [{"compress": {"onRead": "Zip"}}]}`
+	if _, err := resolveSettings(pod, nil, nil); err == nil {
+		t.Error("invalid configs should be rejected")
+	}
+}
+
+func TestMakeProxyFiltersNamespaceDefaults(t *testing.T) {
+	t.Parallel()
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		FiltersAnnotation:         "- compress: {onRead: Compress}",
+		ReceiverFiltersAnnotation: "- compress: {onRead: Decompress}",
+	}}}
+	proxy := &v1alpha1.Proxy{Spec: v1alpha1.ProxySpec{ReceiverFilters: []v1alpha1.Filter{}}}
+	filters, err := makeProxyFilters(proxy, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters.Sender) != 1 {
+		t.Error("proxies without filters should use the namespace defaults")
+	}
+	if len(filters.Receiver) != 0 {
+		t.Error("proxies setting filters should ignore the namespace defaults")
+	}
+}
+
+func TestMakeProxyFiltersFirewall(t *testing.T) {
+	t.Parallel()
+	proxy := &v1alpha1.Proxy{Spec: v1alpha1.ProxySpec{Firewall: &v1alpha1.FirewallSpec{AllowedCIDRs: []string{"10.1.0.0/16"}}}}
+	filters, err := makeProxyFilters(proxy, &corev1.Namespace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filters.Firewall == nil || len(filters.Firewall.CIDRs) != 1 {
+		t.Error("proxies with a firewall should enable it on their receiver side proxies")
+	}
+	proxy.Spec.Firewall.AllowedCIDRs = []string{"10.1.0.0"}
+	if _, err := makeProxyFilters(proxy, &corev1.Namespace{}); err == nil {
+		t.Error("invalid CIDRs should be rejected")
+	}
+}
+
+func TestMakeFiltersLocalRateLimit(t *testing.T) {
+	t.Parallel()
+	limit := &v1alpha1.LocalRateLimitFilter{MaxPackets: 100, Period: metav1.Duration{Duration: time.Second}}
+	chain, err := makeFilters([]v1alpha1.Filter{{LocalRateLimit: limit}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, ok := chain[0].(*quilkin.LocalRateLimit); !ok || l.MaxPackets != 100 {
+		t.Errorf("unexpected chain %v", chain)
+	}
+	if _, err := makeFilters([]v1alpha1.Filter{{LocalRateLimit: &v1alpha1.LocalRateLimitFilter{}}}); err == nil {
+		t.Error("rate limits without packets should be rejected")
+	}
+	if _, err := makeFilters([]v1alpha1.Filter{{LocalRateLimit: limit, Compress: &v1alpha1.CompressFilter{}}}); err == nil {
+		t.Error("filters setting two types should be rejected")
+	}
+}
+
+func TestResolveSettingsPortConflicts(t *testing.T) {
+	t.Parallel()
+	proxies := map[string]*v1alpha1.Proxy{"game": {
+		ObjectMeta: metav1.ObjectMeta{Name: "game"},
+		Spec:       v1alpha1.ProxySpec{Sidecar: &v1alpha1.SidecarSpec{Port: 7100}},
+	}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{SenderAnnotation: "game"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "game", Ports: []corev1.ContainerPort{
+			{ContainerPort: 7100, Protocol: corev1.ProtocolUDP},
+			{ContainerPort: 7101, Protocol: corev1.ProtocolUDP},
+		}}}},
+	}
+	if _, err := resolveSettings(pod, nil, proxies); err == nil {
+		t.Error("ports declared by the pod should be rejected")
+	}
+
+	pod.Annotations[PortConflictAnnotation] = PortConflictAuto
+	settings, err := resolveSettings(pod, nil, proxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.ProxyPort != 7102 {
+		t.Errorf("expected the next free port, got %d", settings.ProxyPort)
+	}
+
+	pod.Annotations[ProxyPortAnnotation] = "7200"
+	if settings, err := resolveSettings(pod, nil, proxies); err != nil || settings.ProxyPort != 7200 {
+		t.Error("pod annotations should override the proxy")
+	}
+}
+
+func TestResolveSettingsMultipleProxies(t *testing.T) {
+	t.Parallel()
+	proxies := map[string]*v1alpha1.Proxy{"telemetry": {
+		ObjectMeta: metav1.ObjectMeta{Name: "telemetry"},
+		Spec:       v1alpha1.ProxySpec{Sidecar: &v1alpha1.SidecarSpec{Port: 8000}},
+	}}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		SenderAnnotation: "game, telemetry,chat",
+	}}}
+	settings, err := resolveSettings(pod, nil, proxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []senderSidecar{
+		{proxy: "game", container: "quilkin", volume: "quilkin-config", proxyPort: 7000, adminPort: 9091},
+		{proxy: "telemetry", container: "quilkin-1", volume: "quilkin-config-1", proxyPort: 8000, adminPort: 9092},
+		{proxy: "chat", container: "quilkin-2", volume: "quilkin-config-2", proxyPort: 7001, adminPort: 9093},
+	}
+	if !reflect.DeepEqual(settings.Sidecars, expected) {
+		t.Errorf("unexpected sidecars %+v", settings.Sidecars)
+	}
+
+	pod.Annotations[SenderAnnotation] = "game,game"
+	if _, err := resolveSettings(pod, nil, nil); err == nil {
+		t.Error("duplicate proxies should be rejected")
+	}
+}
@@ -0,0 +1,309 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// ProxyLabel is the label key holding the proxy name on objects the controller creates for a proxy
+	ProxyLabel = "nfowler.dev/quilkin.proxy"
+	// ManagedByLabel is the label key marking objects as created by the controller
+	ManagedByLabel = "managed-by"
+	// ManagedByValue is the value of ManagedByLabel for objects created by the controller
+	ManagedByValue = "quilkin-controller"
+	// endpointSliceManagedBy stops the kubernetes EndpointSlice controller from touching published slices
+	endpointSliceManagedBy = "quilkin.nfowler.dev/controller"
+)
+
+// EndpointPublisher mirrors the receivers of every proxy in the store into EndpointSlices so that
+// proxy membership is visible to kubectl and other tooling. A headless Service without a selector
+// can optionally be created per proxy to own the slices.
+type EndpointPublisher struct {
+	client        client.Client
+	logger        *zap.SugaredLogger
+	store         *store.SotwStore
+	namespace     string
+	createService bool
+}
+
+// NewEndpointPublisher constructs a new EndpointPublisher struct from the passed arguments.
+// Objects are published in the namespace provided.
+func NewEndpointPublisher(c client.Client, l *zap.SugaredLogger, s *store.SotwStore, namespace string, createService bool) *EndpointPublisher {
+	return &EndpointPublisher{
+		client:        c,
+		logger:        l,
+		store:         s,
+		namespace:     namespace,
+		createService: createService,
+	}
+}
+
+// SetupWithManager registers the publisher with the manager. Requests are keyed by proxy name and
+// are triggered by store changes as well as changes to the published slices.
+func (p *EndpointPublisher) SetupWithManager(mgr ctrl.Manager) error {
+	c, err := controller.New("endpoint-publisher", mgr, controller.Options{Reconciler: p})
+	if err != nil {
+		return err
+	}
+	events := make(chan event.GenericEvent)
+	watch := p.store.Watch()
+	err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		for {
+			select {
+			case <-watch.Ready():
+			case <-ctx.Done():
+				return nil
+			}
+			for _, proxyName := range watch.Take() {
+				select {
+				case events <- event.GenericEvent{Object: &discoveryv1.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: p.namespace, Name: proxyName}}}:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}
+	}))
+	if err != nil {
+		return err
+	}
+	if err := c.Watch(&source.Channel{Source: events}, &handler.EnqueueRequestForObject{}); err != nil {
+		return err
+	}
+	published := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		_, ok := obj.GetLabels()[ProxyLabel]
+		return ok && obj.GetNamespace() == p.namespace && obj.GetLabels()[ManagedByLabel] == ManagedByValue
+	})
+	toProxy := handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: p.namespace, Name: obj.GetLabels()[ProxyLabel]}}}
+	})
+	if err := c.Watch(&source.Kind{Type: &discoveryv1.EndpointSlice{}}, toProxy, published); err != nil {
+		return err
+	}
+	return c.Watch(&source.Kind{Type: &corev1.Service{}}, toProxy, published)
+}
+
+// Reconcile publishes the receivers of the proxy, removing the published objects once the proxy is gone
+func (p *EndpointPublisher) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	proxyName := req.Name
+	serviceName := "quilkin-" + proxyName
+	if errs := validation.IsDNS1035Label(serviceName); len(errs) > 0 {
+		p.logger.Warnw("Proxy name can't be published", "proxy", proxyName, "errors", errs)
+		return reconcile.Result{}, nil
+	}
+
+	node, ok := p.store.Node(proxyName)
+	desired := make([]*discoveryv1.EndpointSlice, 0)
+	if ok {
+		desired = makeEndpointSlices(p.namespace, serviceName, proxyName, node.Endpoints)
+	}
+
+	var owner *corev1.Service
+	if p.createService && len(desired) > 0 {
+		svc, err := p.ensureService(ctx, serviceName, proxyName, desired)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		owner = svc
+	}
+
+	existing := &discoveryv1.EndpointSliceList{}
+	if err := p.client.List(ctx, existing, client.InNamespace(p.namespace), client.MatchingLabels{ProxyLabel: proxyName, ManagedByLabel: ManagedByValue}); err != nil {
+		return reconcile.Result{}, err
+	}
+	for _, slice := range desired {
+		if owner != nil {
+			if err := controllerutil.SetControllerReference(owner, slice, p.client.Scheme()); err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+		if err := p.applySlice(ctx, slice, existing.Items); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	for i := range existing.Items {
+		if !containsSlice(desired, existing.Items[i].Name) {
+			p.logger.Infow("Deleting published endpoint slice", "proxy", proxyName, "slice", existing.Items[i].Name)
+			if err := p.client.Delete(ctx, &existing.Items[i]); client.IgnoreNotFound(err) != nil {
+				return reconcile.Result{}, err
+			}
+		}
+	}
+
+	if len(desired) == 0 {
+		svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: p.namespace, Name: serviceName}}
+		err := p.client.Get(ctx, types.NamespacedName{Namespace: p.namespace, Name: serviceName}, svc)
+		if err == nil && svc.Labels[ManagedByLabel] == ManagedByValue {
+			p.logger.Infow("Deleting published service", "proxy", proxyName, "service", serviceName)
+			return reconcile.Result{}, client.IgnoreNotFound(p.client.Delete(ctx, svc))
+		}
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	return reconcile.Result{}, nil
+}
+
+// ensureService creates or updates the headless Service for the proxy with a port for each published slice
+func (p *EndpointPublisher) ensureService(ctx context.Context, serviceName string, proxyName string, slices []*discoveryv1.EndpointSlice) (*corev1.Service, error) {
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: p.namespace, Name: serviceName}}
+	_, err := controllerutil.CreateOrUpdate(ctx, p.client, svc, func() error {
+		if svc.Labels == nil {
+			svc.Labels = make(map[string]string)
+		}
+		svc.Labels[ManagedByLabel] = ManagedByValue
+		svc.Labels[ProxyLabel] = proxyName
+		svc.Spec.ClusterIP = corev1.ClusterIPNone
+		svc.Spec.Selector = nil
+		ports := make([]corev1.ServicePort, 0, len(slices))
+		seen := make(map[string]struct{})
+		for _, slice := range slices {
+			port := slice.Ports[0]
+			if _, ok := seen[*port.Name]; ok {
+				continue
+			}
+			seen[*port.Name] = struct{}{}
+			ports = append(ports, corev1.ServicePort{Name: *port.Name, Port: *port.Port, Protocol: corev1.ProtocolUDP})
+		}
+		svc.Spec.Ports = ports
+		return nil
+	})
+	return svc, err
+}
+
+// applySlice creates the slice or updates the existing one with the same name
+func (p *EndpointPublisher) applySlice(ctx context.Context, slice *discoveryv1.EndpointSlice, existing []discoveryv1.EndpointSlice) error {
+	for i := range existing {
+		if existing[i].Name != slice.Name {
+			continue
+		}
+		current := existing[i].DeepCopy()
+		current.Labels = slice.Labels
+		current.OwnerReferences = slice.OwnerReferences
+		current.Endpoints = slice.Endpoints
+		current.Ports = slice.Ports
+		if equality.Semantic.DeepEqual(current, &existing[i]) {
+			return nil
+		}
+		return p.client.Update(ctx, current)
+	}
+	p.logger.Infow("Publishing endpoint slice", "proxy", slice.Labels[ProxyLabel], "slice", slice.Name)
+	err := p.client.Create(ctx, slice)
+	if apierrors.IsAlreadyExists(err) {
+		// The cache hasn't seen the slice yet, the watch will requeue the proxy.
+		return nil
+	}
+	return err
+}
+
+// makeEndpointSlices groups the endpoints of a proxy by address family and port, as every endpoint
+// in a slice has to share both, and builds a slice for each group.
+func makeEndpointSlices(namespace string, serviceName string, proxyName string, endpoints map[string]*store.Endpoint) []*discoveryv1.EndpointSlice {
+	type group struct {
+		addressType discoveryv1.AddressType
+		port        int
+	}
+	groups := make(map[group][]string)
+	for _, ep := range endpoints {
+		ip := net.ParseIP(ep.Address)
+		if ip == nil {
+			continue
+		}
+		g := group{addressType: discoveryv1.AddressTypeIPv4, port: ep.Port}
+		if ip.To4() == nil {
+			g.addressType = discoveryv1.AddressTypeIPv6
+		}
+		groups[g] = append(groups[g], ep.Address)
+	}
+
+	slices := make([]*discoveryv1.EndpointSlice, 0, len(groups))
+	for g, addresses := range groups {
+		addresses = uniqueSorted(addresses)
+		portName := fmt.Sprintf("udp-%d", g.port)
+		port := int32(g.port)
+		protocol := corev1.ProtocolUDP
+		ready := true
+		slice := &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      fmt.Sprintf("%s-%s-%d", serviceName, strings.ToLower(string(g.addressType)), g.port),
+				Labels: map[string]string{
+					ManagedByLabel:               ManagedByValue,
+					ProxyLabel:                   proxyName,
+					discoveryv1.LabelServiceName: serviceName,
+					discoveryv1.LabelManagedBy:   endpointSliceManagedBy,
+				},
+			},
+			AddressType: g.addressType,
+			Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port, Protocol: &protocol}},
+		}
+		for _, address := range addresses {
+			slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+				Addresses:  []string{address},
+				Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+			})
+		}
+		slices = append(slices, slice)
+	}
+	sort.Slice(slices, func(i, j int) bool { return slices[i].Name < slices[j].Name })
+	return slices
+}
+
+// containsSlice returns whether a slice with the name provided is in the list
+func containsSlice(slices []*discoveryv1.EndpointSlice, name string) bool {
+	for _, slice := range slices {
+		if slice.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueSorted sorts the strings provided and removes any duplicates
+func uniqueSorted(values []string) []string {
+	sort.Strings(values)
+	unique := values[:0]
+	for i, value := range values {
+		if i == 0 || values[i-1] != value {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	"github.com/nfowl/quilkin-controller/internal/store"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+func TestMakeEndpointSlices(t *testing.T) {
+	t.Parallel()
+	endpoints := map[string]*store.Endpoint{
+		"pod-1":        {Address: "10.0.0.1", Port: 3000},
+		"pod-2":        {Address: "10.0.0.2", Port: 3000},
+		"svc/10.0.0.3": {Address: "10.0.0.3", Port: 4000},
+		"ext/v6":       {Address: "fd00::1", Port: 3000},
+		"ext/invalid":  {Address: "not-an-ip", Port: 3000},
+	}
+	slices := makeEndpointSlices("default", "quilkin-proxy", "proxy", endpoints)
+	if len(slices) != 3 {
+		t.Fatalf("expected 3 slices got %d", len(slices))
+	}
+	expected := []struct {
+		name        string
+		addressType discoveryv1.AddressType
+		endpoints   int
+	}{
+		{"quilkin-proxy-ipv4-3000", discoveryv1.AddressTypeIPv4, 2},
+		{"quilkin-proxy-ipv4-4000", discoveryv1.AddressTypeIPv4, 1},
+		{"quilkin-proxy-ipv6-3000", discoveryv1.AddressTypeIPv6, 1},
+	}
+	for i, e := range expected {
+		if slices[i].Name != e.name || slices[i].AddressType != e.addressType || len(slices[i].Endpoints) != e.endpoints {
+			t.Errorf("slice %d mismatch: %s %s %d", i, slices[i].Name, slices[i].AddressType, len(slices[i].Endpoints))
+		}
+		if slices[i].Labels[ProxyLabel] != "proxy" || slices[i].Labels[discoveryv1.LabelServiceName] != "quilkin-proxy" {
+			t.Errorf("slice %d missing labels", i)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nfowl/quilkin-controller/api/v1alpha1"
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// DefaultResolveInterval is how often hostnames of external receivers are resolved when not set
+const DefaultResolveInterval = 30 * time.Second
+
+// ExternalReceiverReconciler registers the endpoints of ExternalReceivers with the store,
+// resolving hostnames periodically and expiring registrations whose lease was not renewed
+type ExternalReceiverReconciler struct {
+	client   client.Client
+	logger   *zap.SugaredLogger
+	store    *store.SotwStore
+	resolver *net.Resolver
+}
+
+// NewExternalReceiverReconciler constructs a new ExternalReceiverReconciler struct from the passed arguments
+func NewExternalReceiverReconciler(c client.Client, l *zap.SugaredLogger, s *store.SotwStore) *ExternalReceiverReconciler {
+	return &ExternalReceiverReconciler{
+		client:   c,
+		logger:   l,
+		store:    s,
+		resolver: net.DefaultResolver,
+	}
+}
+
+// SetupWithManager registers the reconciler with the manager.
+// Status updates are ignored as every resolve writes the status.
+func (e *ExternalReceiverReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.ExternalReceiver{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(e)
+}
+
+// Reconcile resolves and registers the endpoints of an ExternalReceiver while its lease is valid
+func (e *ExternalReceiverReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	receiver := &v1alpha1.ExternalReceiver{}
+	if err := e.client.Get(ctx, req.NamespacedName, receiver); err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	source := externalReceiverSource(receiver)
+
+	if !receiver.DeletionTimestamp.IsZero() {
+		if containsString(receiver.GetFinalizers(), Finalizer) {
+			e.logger.Infow("Removing external receiver", "proxy", receiver.Status.Proxy, "receiver", req.NamespacedName.String())
+			e.store.RemoveReceivers(receiver.Status.Proxy, source)
+			controllerutil.RemoveFinalizer(receiver, Finalizer)
+			return reconcile.Result{}, e.client.Update(ctx, receiver)
+		}
+		return reconcile.Result{}, nil
+	}
+
+	if !containsString(receiver.GetFinalizers(), Finalizer) {
+		controllerutil.AddFinalizer(receiver, Finalizer)
+		return reconcile.Result{}, e.client.Update(ctx, receiver)
+	}
+
+	// The proxy was changed so the endpoints need to be removed from the old one
+	if receiver.Status.Proxy != "" && receiver.Status.Proxy != receiver.Spec.Proxy {
+		e.logger.Infow("Moving external receiver", "from", receiver.Status.Proxy, "to", receiver.Spec.Proxy, "receiver", req.NamespacedName.String())
+		e.store.RemoveReceivers(receiver.Status.Proxy, source)
+	}
+
+	now := time.Now()
+	remaining, leased := leaseRemaining(receiver, now)
+	if leased && remaining <= 0 {
+		e.logger.Infow("External receiver lease expired", "proxy", receiver.Spec.Proxy, "receiver", req.NamespacedName.String())
+		e.store.RemoveReceivers(receiver.Spec.Proxy, source)
+		status := receiver.Status.DeepCopy()
+		status.Proxy = receiver.Spec.Proxy
+		status.Endpoints = 0
+		status.Expired = true
+		return reconcile.Result{}, e.updateStatus(ctx, receiver, status)
+	}
+
+	endpoints := e.resolveEndpoints(ctx, receiver)
+	changed := e.store.SetReceivers(receiver.Spec.Proxy, source, endpoints)
+
+	status := &v1alpha1.ExternalReceiverStatus{Proxy: receiver.Spec.Proxy, Endpoints: len(endpoints), LastResolveTime: receiver.Status.LastResolveTime}
+	// Resolving to the same endpoints leaves the status alone so periodic resolves don't write to the API server
+	if changed || status.LastResolveTime == nil {
+		resolveTime := metav1.NewTime(now)
+		status.LastResolveTime = &resolveTime
+	}
+	if err := e.updateStatus(ctx, receiver, status); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	requeue := time.Duration(0)
+	if hasHostnames(receiver) {
+		requeue = resolveInterval(receiver)
+	}
+	if leased && (requeue == 0 || remaining < requeue) {
+		requeue = remaining
+	}
+	return reconcile.Result{RequeueAfter: requeue}, nil
+}
+
+// resolveEndpoints turns the endpoints of the receiver into store endpoints, resolving any hostnames.
+// Endpoints that fail to resolve are skipped so a single bad entry doesn't remove the rest.
+func (e *ExternalReceiverReconciler) resolveEndpoints(ctx context.Context, receiver *v1alpha1.ExternalReceiver) map[string]*store.Endpoint {
+	endpoints := make(map[string]*store.Endpoint)
+	for _, ep := range receiver.Spec.Endpoints {
+		weight := uint32(0)
+		if ep.Weight != nil && *ep.Weight > 0 {
+			weight = uint32(*ep.Weight)
+		}
+		addresses := []string{ep.Address}
+		if ep.Hostname != "" {
+			ips, err := e.resolver.LookupIPAddr(ctx, ep.Hostname)
+			if err != nil {
+				e.logger.Warnw("Error resolving external receiver", "hostname", ep.Hostname, "receiver", receiver.Namespace+"/"+receiver.Name, "error", err.Error())
+				continue
+			}
+			addresses = addresses[:0]
+			for _, ip := range ips {
+				addresses = append(addresses, ip.IP.String())
+			}
+		} else if net.ParseIP(ep.Address) == nil {
+			e.logger.Warnw("Invalid external receiver address", "address", ep.Address, "receiver", receiver.Namespace+"/"+receiver.Name)
+			continue
+		}
+		for _, address := range addresses {
+			endpoints[net.JoinHostPort(address, strconv.Itoa(int(ep.Port)))] = &store.Endpoint{Address: address, Port: int(ep.Port), Weight: weight}
+		}
+	}
+	return endpoints
+}
+
+// updateStatus writes the status provided if it differs from the current one
+func (e *ExternalReceiverReconciler) updateStatus(ctx context.Context, receiver *v1alpha1.ExternalReceiver, status *v1alpha1.ExternalReceiverStatus) error {
+	if equality.Semantic.DeepEqual(receiver.Status, *status) {
+		return nil
+	}
+	receiver.Status = *status
+	return e.client.Status().Update(ctx, receiver)
+}
+
+// externalReceiverSource returns the store source key used for endpoints added by an ExternalReceiver
+func externalReceiverSource(receiver *v1alpha1.ExternalReceiver) string {
+	return "externalreceiver/" + receiver.Namespace + "/" + receiver.Name
+}
+
+// leaseRemaining returns how long is left on the receiver's lease and whether it has one at all.
+// A leased receiver that has never been renewed has already expired.
+func leaseRemaining(receiver *v1alpha1.ExternalReceiver, now time.Time) (time.Duration, bool) {
+	if receiver.Spec.LeaseDurationSeconds == nil {
+		return 0, false
+	}
+	if receiver.Spec.RenewTime == nil {
+		return 0, true
+	}
+	expiry := receiver.Spec.RenewTime.Add(time.Duration(*receiver.Spec.LeaseDurationSeconds) * time.Second)
+	return expiry.Sub(now), true
+}
+
+// resolveInterval returns the configured resolve interval or the default
+func resolveInterval(receiver *v1alpha1.ExternalReceiver) time.Duration {
+	if receiver.Spec.ResolveInterval == nil || receiver.Spec.ResolveInterval.Duration <= 0 {
+		return DefaultResolveInterval
+	}
+	return receiver.Spec.ResolveInterval.Duration
+}
+
+// hasHostnames returns whether any of the receiver endpoints need to be resolved
+func hasHostnames(receiver *v1alpha1.ExternalReceiver) bool {
+	for _, ep := range receiver.Spec.Endpoints {
+		if ep.Hostname != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nfowl/quilkin-controller/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLeaseRemaining(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	receiver := &v1alpha1.ExternalReceiver{}
+
+	if _, leased := leaseRemaining(receiver, now); leased {
+		t.Error("receiver without a lease duration shouldn't be leased")
+	}
+
+	lease := int32(60)
+	receiver.Spec.LeaseDurationSeconds = &lease
+	if remaining, leased := leaseRemaining(receiver, now); !leased || remaining > 0 {
+		t.Error("receiver that was never renewed should be expired")
+	}
+
+	renewed := metav1.NewMicroTime(now.Add(-30 * time.Second))
+	receiver.Spec.RenewTime = &renewed
+	if remaining, leased := leaseRemaining(receiver, now); !leased || remaining != 30*time.Second {
+		t.Errorf("expected 30s remaining got %s", remaining)
+	}
+
+	expired := metav1.NewMicroTime(now.Add(-90 * time.Second))
+	receiver.Spec.RenewTime = &expired
+	if remaining, _ := leaseRemaining(receiver, now); remaining > 0 {
+		t.Error("lease should have expired")
+	}
+}
@@ -0,0 +1,476 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net"
+
+	"github.com/nfowl/quilkin-controller/api/v1alpha1"
+	"github.com/nfowl/quilkin-controller/internal/gatewayapi"
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// GatewayControllerName is the controller name GatewayClasses use to select this controller
+	GatewayControllerName = "nfowler.dev/quilkin-controller"
+	// routeBackendField is the field index used to look up UDPRoutes by the Services they route to
+	routeBackendField = ".spec.rules.backendRefs"
+	// routeParentField is the field index used to look up UDPRoutes by the Gateways they attach to
+	routeParentField = ".spec.parentRefs"
+)
+
+// GatewayClassReconciler accepts the GatewayClasses that select this controller
+type GatewayClassReconciler struct {
+	client client.Client
+	logger *zap.SugaredLogger
+}
+
+// NewGatewayClassReconciler constructs a new GatewayClassReconciler struct from the passed arguments
+func NewGatewayClassReconciler(c client.Client, l *zap.SugaredLogger) *GatewayClassReconciler {
+	return &GatewayClassReconciler{
+		client: c,
+		logger: l,
+	}
+}
+
+// SetupWithManager registers the reconciler with the manager
+func (g *GatewayClassReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).For(&gatewayapi.GatewayClass{}).Complete(g)
+}
+
+// Reconcile marks the GatewayClass as accepted if it belongs to this controller
+func (g *GatewayClassReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	class := &gatewayapi.GatewayClass{}
+	if err := g.client.Get(ctx, req.NamespacedName, class); err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	if class.Spec.ControllerName != GatewayControllerName {
+		return reconcile.Result{}, nil
+	}
+	original := class.DeepCopy()
+	meta.SetStatusCondition(&class.Status.Conditions, metav1.Condition{
+		Type:               gatewayapi.ConditionAccepted,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Accepted",
+		Message:            "Handled by " + GatewayControllerName,
+		ObservedGeneration: class.Generation,
+	})
+	if equality.Semantic.DeepEqual(original.Status, class.Status) {
+		return reconcile.Result{}, nil
+	}
+	g.logger.Infow("Accepting gateway class", "class", class.Name)
+	return reconcile.Result{}, g.client.Status().Patch(ctx, class, client.MergeFrom(original))
+}
+
+// GatewayReconciler provisions a gateway Proxy for every Gateway using a class owned by this controller
+type GatewayReconciler struct {
+	client client.Client
+	logger *zap.SugaredLogger
+}
+
+// NewGatewayReconciler constructs a new GatewayReconciler struct from the passed arguments
+func NewGatewayReconciler(c client.Client, l *zap.SugaredLogger) *GatewayReconciler {
+	return &GatewayReconciler{
+		client: c,
+		logger: l,
+	}
+}
+
+// SetupWithManager registers the reconciler with the manager
+func (g *GatewayReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&gatewayapi.Gateway{}).
+		Owns(&v1alpha1.Proxy{}).
+		Watches(&source.Kind{Type: &gatewayapi.GatewayClass{}}, handler.EnqueueRequestsFromMapFunc(g.gatewaysForClass)).
+		Complete(g)
+}
+
+// Reconcile creates the Proxy for the Gateway's UDP listener and reports its state in the Gateway status
+func (g *GatewayReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	gateway := &gatewayapi.Gateway{}
+	if err := g.client.Get(ctx, req.NamespacedName, gateway); err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	owned, err := isOwnedGatewayClass(ctx, g.client, gateway.Spec.GatewayClassName)
+	if err != nil || !owned || !gateway.DeletionTimestamp.IsZero() {
+		return reconcile.Result{}, err
+	}
+	original := gateway.DeepCopy()
+
+	listener, ok := udpListener(gateway)
+	if !ok {
+		setGatewayConditions(gateway, metav1.ConditionFalse, "ListenersNotValid", "Gateway has no UDP listener", metav1.ConditionFalse, "Invalid")
+		return reconcile.Result{}, g.patchStatus(ctx, gateway, original)
+	}
+
+	proxy := &v1alpha1.Proxy{ObjectMeta: metav1.ObjectMeta{Namespace: gateway.Namespace, Name: gateway.Name}}
+	_, err = controllerutil.CreateOrUpdate(ctx, g.client, proxy, func() error {
+		if proxy.Spec.Gateway == nil {
+			proxy.Spec.Gateway = &v1alpha1.GatewaySpec{}
+		}
+		proxy.Spec.Gateway.Port = listener.Port
+		proxy.Spec.Gateway.ServiceType = corev1.ServiceTypeLoadBalancer
+		return controllerutil.SetControllerReference(gateway, proxy, g.client.Scheme())
+	})
+	if _, conflict := err.(*controllerutil.AlreadyOwnedError); conflict {
+		setGatewayConditions(gateway, metav1.ConditionFalse, "Conflicted", "Proxy "+proxy.Name+" is owned by another object", metav1.ConditionFalse, "Invalid")
+		return reconcile.Result{}, g.patchStatus(ctx, gateway, original)
+	}
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	gateway.Status.Addresses = gatewayAddresses(proxy.Status.Addresses)
+	if proxy.Status.ReadyReplicas > 0 {
+		setGatewayConditions(gateway, metav1.ConditionTrue, "Accepted", "", metav1.ConditionTrue, "Programmed")
+	} else {
+		setGatewayConditions(gateway, metav1.ConditionTrue, "Accepted", "", metav1.ConditionFalse, "Pending")
+	}
+	return reconcile.Result{}, g.patchStatus(ctx, gateway, original)
+}
+
+// patchStatus writes the gateway status if it changed
+func (g *GatewayReconciler) patchStatus(ctx context.Context, gateway *gatewayapi.Gateway, original *gatewayapi.Gateway) error {
+	if equality.Semantic.DeepEqual(original.Status, gateway.Status) {
+		return nil
+	}
+	return g.client.Status().Patch(ctx, gateway, client.MergeFrom(original))
+}
+
+// gatewaysForClass returns reconcile requests for every Gateway using the class provided
+func (g *GatewayReconciler) gatewaysForClass(obj client.Object) []reconcile.Request {
+	gateways := &gatewayapi.GatewayList{}
+	if err := g.client.List(context.Background(), gateways); err != nil {
+		g.logger.Errorw("Error listing gateways", "error", err.Error())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0)
+	for _, gateway := range gateways.Items {
+		if gateway.Spec.GatewayClassName == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: gateway.Namespace, Name: gateway.Name}})
+		}
+	}
+	return requests
+}
+
+// UDPRouteReconciler adds the backends of UDPRoutes as receivers of the proxies of the Gateways they attach to
+type UDPRouteReconciler struct {
+	client client.Client
+	logger *zap.SugaredLogger
+	store  *store.SotwStore
+}
+
+// NewUDPRouteReconciler constructs a new UDPRouteReconciler struct from the passed arguments
+func NewUDPRouteReconciler(c client.Client, l *zap.SugaredLogger, s *store.SotwStore) *UDPRouteReconciler {
+	return &UDPRouteReconciler{
+		client: c,
+		logger: l,
+		store:  s,
+	}
+}
+
+// SetupWithManager registers the reconciler and the Gateway/Service/EndpointSlice watches with the manager
+func (u *UDPRouteReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	indexer := mgr.GetFieldIndexer()
+	err := indexer.IndexField(context.Background(), &gatewayapi.UDPRoute{}, routeBackendField, func(obj client.Object) []string {
+		route := obj.(*gatewayapi.UDPRoute)
+		keys := make([]string, 0)
+		for _, rule := range route.Spec.Rules {
+			for _, ref := range rule.BackendRefs {
+				keys = append(keys, ref.Name)
+			}
+		}
+		return keys
+	})
+	if err != nil {
+		return err
+	}
+	err = indexer.IndexField(context.Background(), &gatewayapi.UDPRoute{}, routeParentField, func(obj client.Object) []string {
+		route := obj.(*gatewayapi.UDPRoute)
+		keys := make([]string, 0)
+		for _, ref := range route.Spec.ParentRefs {
+			if key, ok := parentGateway(route.Namespace, ref); ok {
+				keys = append(keys, key.String())
+			}
+		}
+		return keys
+	})
+	if err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&gatewayapi.UDPRoute{}).
+		Watches(&source.Kind{Type: &gatewayapi.Gateway{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return u.routesMatching(client.MatchingFields{routeParentField: types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}.String()})
+		})).
+		Watches(&source.Kind{Type: &corev1.Service{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return u.routesMatching(client.InNamespace(obj.GetNamespace()), client.MatchingFields{routeBackendField: obj.GetName()})
+		})).
+		Watches(&source.Kind{Type: &discoveryv1.EndpointSlice{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return u.routesMatching(client.InNamespace(obj.GetNamespace()), client.MatchingFields{routeBackendField: obj.GetLabels()[discoveryv1.LabelServiceName]})
+		})).
+		Complete(u)
+}
+
+// Reconcile syncs the backends of the route into every attached gateway proxy and writes the route status
+func (u *UDPRouteReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	route := &gatewayapi.UDPRoute{}
+	if err := u.client.Get(ctx, req.NamespacedName, route); err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	source := "udproute/" + route.Namespace + "/" + route.Name
+	original := route.DeepCopy()
+
+	if !route.DeletionTimestamp.IsZero() {
+		if containsString(route.GetFinalizers(), Finalizer) {
+			for _, parent := range route.Status.Parents {
+				if parent.ControllerName == GatewayControllerName {
+					u.store.RemoveReceivers(parent.ParentRef.Name, source)
+				}
+			}
+			controllerutil.RemoveFinalizer(route, Finalizer)
+			return reconcile.Result{}, u.client.Patch(ctx, route, client.MergeFrom(original))
+		}
+		return reconcile.Result{}, nil
+	}
+
+	// Find the parents that are gateways handled by this controller
+	parents := make([]gatewayapi.RouteParentStatus, 0)
+	attached := make(map[string]struct{})
+	for _, ref := range route.Spec.ParentRefs {
+		key, ok := parentGateway(route.Namespace, ref)
+		if !ok {
+			continue
+		}
+		gateway := &gatewayapi.Gateway{}
+		if err := u.client.Get(ctx, key, gateway); err != nil {
+			if client.IgnoreNotFound(err) != nil {
+				return reconcile.Result{}, err
+			}
+			continue
+		}
+		owned, err := isOwnedGatewayClass(ctx, u.client, gateway.Spec.GatewayClassName)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if !owned {
+			continue
+		}
+		status := gatewayapi.RouteParentStatus{ParentRef: ref, ControllerName: GatewayControllerName}
+		if _, ok := udpListener(gateway); ok {
+			attached[gateway.Name] = struct{}{}
+			setRouteCondition(&status, route, gatewayapi.ConditionAccepted, metav1.ConditionTrue, "Accepted", "")
+		} else {
+			setRouteCondition(&status, route, gatewayapi.ConditionAccepted, metav1.ConditionFalse, "NoMatchingParent", "Gateway has no UDP listener")
+		}
+		parents = append(parents, status)
+	}
+	if len(parents) == 0 && !containsString(route.GetFinalizers(), Finalizer) {
+		return reconcile.Result{}, nil
+	}
+
+	if !containsString(route.GetFinalizers(), Finalizer) {
+		controllerutil.AddFinalizer(route, Finalizer)
+		return reconcile.Result{}, u.client.Patch(ctx, route, client.MergeFrom(original))
+	}
+
+	endpoints, resolvedStatus, reason, message, err := u.routeEndpoints(ctx, route)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	for i := range parents {
+		setRouteCondition(&parents[i], route, gatewayapi.ConditionResolvedRefs, resolvedStatus, reason, message)
+	}
+
+	for _, parent := range route.Status.Parents {
+		if _, ok := attached[parent.ParentRef.Name]; !ok && parent.ControllerName == GatewayControllerName {
+			u.logger.Infow("Detaching route from gateway", "route", req.NamespacedName.String(), "gateway", parent.ParentRef.Name)
+			u.store.RemoveReceivers(parent.ParentRef.Name, source)
+		}
+	}
+	for proxyName := range attached {
+		u.store.SetReceivers(proxyName, source, endpoints)
+	}
+
+	// Keep the status reported by other controllers
+	for _, parent := range route.Status.Parents {
+		if parent.ControllerName != GatewayControllerName {
+			parents = append(parents, parent)
+		}
+	}
+	route.Status.Parents = parents
+	if equality.Semantic.DeepEqual(original.Status, route.Status) {
+		return reconcile.Result{}, nil
+	}
+	return reconcile.Result{}, u.client.Status().Patch(ctx, route, client.MergeFrom(original))
+}
+
+// routeEndpoints resolves every backend of the route into endpoints along with the ResolvedRefs condition.
+// Backends that can't be resolved are skipped so the rest of the route keeps working.
+func (u *UDPRouteReconciler) routeEndpoints(ctx context.Context, route *gatewayapi.UDPRoute) (map[string]*store.Endpoint, metav1.ConditionStatus, string, string, error) {
+	endpoints := make(map[string]*store.Endpoint)
+	status, reason, message := metav1.ConditionTrue, "ResolvedRefs", ""
+	for _, rule := range route.Spec.Rules {
+		for _, ref := range rule.BackendRefs {
+			if (ref.Group != nil && *ref.Group != "") || (ref.Kind != nil && *ref.Kind != "Service") {
+				status, reason, message = metav1.ConditionFalse, "InvalidKind", "Only Service backends are supported"
+				continue
+			}
+			if ref.Namespace != nil && *ref.Namespace != route.Namespace {
+				status, reason, message = metav1.ConditionFalse, "RefNotPermitted", "Cross namespace backends are not supported"
+				continue
+			}
+			if ref.Port == nil {
+				status, reason, message = metav1.ConditionFalse, "UnsupportedValue", "Backend "+ref.Name+" has no port"
+				continue
+			}
+			backendEndpoints, ok, err := lookupServiceEndpoints(ctx, u.client, route.Namespace, ref.Name, intstr.FromInt(int(*ref.Port)))
+			if err != nil {
+				return nil, status, reason, message, err
+			}
+			if !ok {
+				status, reason, message = metav1.ConditionFalse, "BackendNotFound", "Service "+ref.Name+" has no matching UDP port"
+				continue
+			}
+			weight := uint32(0)
+			if ref.Weight != nil && *ref.Weight > 0 {
+				weight = uint32(*ref.Weight)
+			}
+			for key, ep := range backendEndpoints {
+				ep.Weight = weight
+				endpoints[key] = ep
+			}
+		}
+	}
+	return endpoints, status, reason, message, nil
+}
+
+// routesMatching returns reconcile requests for the UDPRoutes matching the list options provided
+func (u *UDPRouteReconciler) routesMatching(opts ...client.ListOption) []reconcile.Request {
+	routes := &gatewayapi.UDPRouteList{}
+	if err := u.client.List(context.Background(), routes, opts...); err != nil {
+		u.logger.Errorw("Error listing udp routes", "error", err.Error())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(routes.Items))
+	for _, route := range routes.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: route.Namespace, Name: route.Name}})
+	}
+	return requests
+}
+
+// isOwnedGatewayClass returns whether the named GatewayClass is handled by this controller
+func isOwnedGatewayClass(ctx context.Context, c client.Client, name string) (bool, error) {
+	class := &gatewayapi.GatewayClass{}
+	if err := c.Get(ctx, types.NamespacedName{Name: name}, class); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	return class.Spec.ControllerName == GatewayControllerName, nil
+}
+
+// udpListener returns the first UDP listener of the gateway. Quilkin listens on a single port per proxy
+// so any other listeners are ignored.
+func udpListener(gateway *gatewayapi.Gateway) (gatewayapi.Listener, bool) {
+	for _, listener := range gateway.Spec.Listeners {
+		if listener.Protocol == gatewayapi.ProtocolUDP {
+			return listener, true
+		}
+	}
+	return gatewayapi.Listener{}, false
+}
+
+// parentGateway returns the Gateway a parent reference points at, defaulting the namespace to the route's
+func parentGateway(namespace string, ref gatewayapi.ParentReference) (types.NamespacedName, bool) {
+	if ref.Group != nil && *ref.Group != gatewayapi.GroupVersion.Group {
+		return types.NamespacedName{}, false
+	}
+	if ref.Kind != nil && *ref.Kind != "Gateway" {
+		return types.NamespacedName{}, false
+	}
+	if ref.Namespace != nil && *ref.Namespace != "" {
+		namespace = *ref.Namespace
+	}
+	return types.NamespacedName{Namespace: namespace, Name: ref.Name}, true
+}
+
+// setGatewayConditions sets the Accepted and Programmed conditions of a gateway
+func setGatewayConditions(gateway *gatewayapi.Gateway, accepted metav1.ConditionStatus, acceptedReason string, message string, programmed metav1.ConditionStatus, programmedReason string) {
+	meta.SetStatusCondition(&gateway.Status.Conditions, metav1.Condition{
+		Type:               gatewayapi.ConditionAccepted,
+		Status:             accepted,
+		Reason:             acceptedReason,
+		Message:            message,
+		ObservedGeneration: gateway.Generation,
+	})
+	meta.SetStatusCondition(&gateway.Status.Conditions, metav1.Condition{
+		Type:               gatewayapi.ConditionProgrammed,
+		Status:             programmed,
+		Reason:             programmedReason,
+		Message:            message,
+		ObservedGeneration: gateway.Generation,
+	})
+}
+
+// setRouteCondition sets a condition on the route parent status, keeping the transition time of
+// the condition already reported for the same parent
+func setRouteCondition(status *gatewayapi.RouteParentStatus, route *gatewayapi.UDPRoute, conditionType string, conditionStatus metav1.ConditionStatus, reason string, message string) {
+	if len(status.Conditions) == 0 {
+		for _, existing := range route.Status.Parents {
+			if existing.ControllerName == GatewayControllerName && equality.Semantic.DeepEqual(existing.ParentRef, status.ParentRef) {
+				status.Conditions = append(status.Conditions, existing.Conditions...)
+			}
+		}
+	}
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: route.Generation,
+	})
+}
+
+// gatewayAddresses converts the addresses of a proxy into gateway status addresses
+func gatewayAddresses(addresses []string) []gatewayapi.GatewayAddress {
+	if len(addresses) == 0 {
+		return nil
+	}
+	result := make([]gatewayapi.GatewayAddress, 0, len(addresses))
+	for _, address := range addresses {
+		addressType := "Hostname"
+		if net.ParseIP(address) != nil {
+			addressType = "IPAddress"
+		}
+		result = append(result, gatewayapi.GatewayAddress{Type: &addressType, Value: address})
+	}
+	return result
+}
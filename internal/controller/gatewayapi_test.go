@@ -0,0 +1,191 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nfowl/quilkin-controller/api/v1alpha1"
+	"github.com/nfowl/quilkin-controller/internal/gatewayapi"
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestParentGateway(t *testing.T) {
+	t.Parallel()
+	key, ok := parentGateway("default", gatewayapi.ParentReference{Name: "game"})
+	if !ok || key.Namespace != "default" || key.Name != "game" {
+		t.Errorf("unexpected parent %s", key)
+	}
+	key, ok = parentGateway("default", gatewayapi.ParentReference{Name: "game", Namespace: stringPtr("infra"), Kind: stringPtr("Gateway"), Group: stringPtr("gateway.networking.k8s.io")})
+	if !ok || key.Namespace != "infra" {
+		t.Errorf("unexpected parent %s", key)
+	}
+	if _, ok = parentGateway("default", gatewayapi.ParentReference{Name: "svc", Kind: stringPtr("Service"), Group: stringPtr("")}); ok {
+		t.Error("non gateway parents should be ignored")
+	}
+}
+
+func TestGatewayAddresses(t *testing.T) {
+	t.Parallel()
+	addresses := gatewayAddresses([]string{"10.0.0.1", "lb.example.com"})
+	if len(addresses) != 2 || *addresses[0].Type != "IPAddress" || *addresses[1].Type != "Hostname" {
+		t.Error("unexpected address types")
+	}
+	if gatewayAddresses(nil) != nil {
+		t.Error("no addresses should be nil")
+	}
+}
+
+// gatewayObjects returns a Gateway of a class owned by the controller and a UDPRoute to a ready Service
+func gatewayObjects() []client.Object {
+	port := int32(7777)
+	return []client.Object{
+		&gatewayapi.GatewayClass{ObjectMeta: metav1.ObjectMeta{Name: "quilkin"}, Spec: gatewayapi.GatewayClassSpec{ControllerName: GatewayControllerName}},
+		&gatewayapi.Gateway{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "games", Name: "game"},
+			Spec:       gatewayapi.GatewaySpec{GatewayClassName: "quilkin", Listeners: []gatewayapi.Listener{{Name: "udp", Port: 7000, Protocol: gatewayapi.ProtocolUDP}}},
+		},
+		&gatewayapi.UDPRoute{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "games", Name: "route"},
+			Spec: gatewayapi.UDPRouteSpec{
+				ParentRefs: []gatewayapi.ParentReference{{Name: "game"}},
+				Rules:      []gatewayapi.UDPRouteRule{{BackendRefs: []gatewayapi.BackendRef{{Name: "server", Port: &port}}}},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "games", Name: "server"},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "game", Port: port, Protocol: corev1.ProtocolUDP}}},
+		},
+		&discoveryv1.EndpointSlice{
+			ObjectMeta:  metav1.ObjectMeta{Namespace: "games", Name: "server-abc", Labels: map[string]string{discoveryv1.LabelServiceName: "server"}},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Ports:       makeSlice("game", port).Ports,
+			Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: boolPtr(true)}}},
+		},
+	}
+}
+
+func TestGatewayReconcile(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	c := newFakeClient(gatewayObjects()...)
+
+	classes := NewGatewayClassReconciler(c, zap.NewNop().Sugar())
+	if _, err := classes.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Name: "quilkin"}}); err != nil {
+		t.Fatal(err)
+	}
+	class := &gatewayapi.GatewayClass{}
+	if err := c.Get(ctx, types.NamespacedName{Name: "quilkin"}, class); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionTrue(class.Status.Conditions, gatewayapi.ConditionAccepted) {
+		t.Error("owned gateway classes should be accepted")
+	}
+
+	key := types.NamespacedName{Namespace: "games", Name: "game"}
+	gateways := NewGatewayReconciler(c, zap.NewNop().Sugar())
+	if _, err := gateways.Reconcile(ctx, reconcile.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	proxy := &v1alpha1.Proxy{}
+	if err := c.Get(ctx, key, proxy); err != nil {
+		t.Fatal(err)
+	}
+	if proxy.Spec.Gateway == nil || proxy.Spec.Gateway.Port != 7000 || len(proxy.OwnerReferences) != 1 {
+		t.Errorf("unexpected proxy %+v", proxy.Spec)
+	}
+	gateway := &gatewayapi.Gateway{}
+	if err := c.Get(ctx, key, gateway); err != nil {
+		t.Fatal(err)
+	}
+	programmed := meta.FindStatusCondition(gateway.Status.Conditions, gatewayapi.ConditionProgrammed)
+	if !meta.IsStatusConditionTrue(gateway.Status.Conditions, gatewayapi.ConditionAccepted) || programmed == nil || programmed.Reason != "Pending" {
+		t.Errorf("gateways without ready replicas should be accepted but pending, got %+v", gateway.Status.Conditions)
+	}
+
+	proxy.Status = v1alpha1.ProxyStatus{ReadyReplicas: 1, Addresses: []string{"10.1.0.1"}}
+	if err := c.Status().Update(ctx, proxy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gateways.Reconcile(ctx, reconcile.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, gateway); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionTrue(gateway.Status.Conditions, gatewayapi.ConditionProgrammed) || len(gateway.Status.Addresses) != 1 {
+		t.Errorf("ready gateways should be programmed, got %+v", gateway.Status)
+	}
+}
+
+func TestUDPRouteReconcile(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	c := newFakeClient(gatewayObjects()...)
+	updates := make(chan store.NodeConfig, 10)
+	s := store.NewSotWStore(updates, make(chan string), zap.NewNop().Sugar())
+	routes := NewUDPRouteReconciler(c, zap.NewNop().Sugar(), s)
+
+	key := types.NamespacedName{Namespace: "games", Name: "route"}
+	// The first reconcile adds the finalizer, the second attaches the route
+	for i := 0; i < 2; i++ {
+		if _, err := routes.Reconcile(ctx, reconcile.Request{NamespacedName: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	node, ok := s.Node("game")
+	if !ok || len(node.Endpoints) != 1 {
+		t.Fatalf("route backends should be receivers of the gateway proxy, got %+v", node.Endpoints)
+	}
+	route := &gatewayapi.UDPRoute{}
+	if err := c.Get(ctx, key, route); err != nil {
+		t.Fatal(err)
+	}
+	if len(route.Status.Parents) != 1 {
+		t.Fatalf("unexpected parents %+v", route.Status.Parents)
+	}
+	conditions := route.Status.Parents[0].Conditions
+	if !meta.IsStatusConditionTrue(conditions, gatewayapi.ConditionAccepted) || !meta.IsStatusConditionTrue(conditions, gatewayapi.ConditionResolvedRefs) {
+		t.Errorf("route should be accepted with resolved refs, got %+v", conditions)
+	}
+
+	// The fake client ignores finalizers, so deletion is marked by hand
+	now := metav1.Now()
+	route.DeletionTimestamp = &now
+	if err := c.Update(ctx, route); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := routes.Reconcile(ctx, reconcile.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Node("game"); ok {
+		t.Error("deleted routes should be removed from the gateway proxy")
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	istioInjectLabel        = "istio-injection"
+	istioRevisionLabel      = "istio.io/rev"
+	istioInjectAnnotation   = "sidecar.istio.io/inject"
+	istioProxyContainer     = "istio-proxy"
+	istioExcludeInbound     = "traffic.sidecar.istio.io/excludeInboundPorts"
+	istioExcludeOutbound    = "traffic.sidecar.istio.io/excludeOutboundPorts"
+	linkerdInjectAnnotation = "linkerd.io/inject"
+	linkerdProxyContainer   = "linkerd-proxy"
+	linkerdSkipInbound      = "config.linkerd.io/skip-inbound-ports"
+	linkerdSkipOutbound     = "config.linkerd.io/skip-outbound-ports"
+	meshInjectionEnabled    = "enabled"
+	meshInjectionDisabled   = "false"
+)
+
+// usesIstio returns whether istio has or will inject its sidecar into the pod
+func usesIstio(pod *corev1.Pod, ns *corev1.Namespace) bool {
+	if hasContainer(pod, istioProxyContainer) {
+		return true
+	}
+	if pod.Annotations[istioInjectAnnotation] == meshInjectionDisabled || pod.Labels[istioInjectAnnotation] == meshInjectionDisabled {
+		return false
+	}
+	if pod.Annotations[istioInjectAnnotation] == "true" || pod.Labels[istioInjectAnnotation] == "true" {
+		return true
+	}
+	_, revision := ns.Labels[istioRevisionLabel]
+	return ns.Labels[istioInjectLabel] == meshInjectionEnabled || revision
+}
+
+// usesLinkerd returns whether linkerd has or will inject its proxy into the pod
+func usesLinkerd(pod *corev1.Pod, ns *corev1.Namespace) bool {
+	if hasContainer(pod, linkerdProxyContainer) {
+		return true
+	}
+	if value, ok := pod.Annotations[linkerdInjectAnnotation]; ok {
+		return value == meshInjectionEnabled
+	}
+	return ns.Annotations[linkerdInjectAnnotation] == meshInjectionEnabled
+}
+
+// addMeshExclusions excludes the ports provided from the traffic redirection of any mesh injected into the pod
+func addMeshExclusions(pod *corev1.Pod, ns *corev1.Namespace, inbound []int, outbound []int) {
+	if usesIstio(pod, ns) {
+		addPortsAnnotation(pod, istioExcludeInbound, inbound)
+		addPortsAnnotation(pod, istioExcludeOutbound, outbound)
+	}
+	if usesLinkerd(pod, ns) {
+		addPortsAnnotation(pod, linkerdSkipInbound, inbound)
+		addPortsAnnotation(pod, linkerdSkipOutbound, outbound)
+	}
+}
+
+// addPortsAnnotation adds ports to a comma separated port list annotation, keeping any existing entries
+func addPortsAnnotation(pod *corev1.Pod, key string, ports []int) {
+	if len(ports) == 0 {
+		return
+	}
+	entries := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, entry := range strings.Split(pod.Annotations[key], ",") {
+		entry = strings.TrimSpace(entry)
+		if _, ok := seen[entry]; entry != "" && !ok {
+			seen[entry] = struct{}{}
+			entries = append(entries, entry)
+		}
+	}
+	added := make([]string, 0)
+	for _, port := range ports {
+		entry := strconv.Itoa(port)
+		if _, ok := seen[entry]; !ok {
+			seen[entry] = struct{}{}
+			added = append(added, entry)
+		}
+	}
+	sort.Strings(added)
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[key] = strings.Join(append(entries, added...), ",")
+}
+
+// hasContainer returns whether the pod has a container or init container with the name provided
+func hasContainer(pod *corev1.Pod, name string) bool {
+	for _, c := range pod.Spec.InitContainers {
+		if c.Name == name {
+			return true
+		}
+	}
+	for _, c := range pod.Spec.Containers {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAddMeshExclusionsIstio(t *testing.T) {
+	t.Parallel()
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{istioInjectLabel: "enabled"}}}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{istioExcludeInbound: "8080"}}}
+	addMeshExclusions(pod, ns, []int{9091, 7000}, []int{18000})
+	if got := pod.Annotations[istioExcludeInbound]; got != "8080,7000,9091" {
+		t.Errorf("existing exclusions should be kept: %s", got)
+	}
+	if got := pod.Annotations[istioExcludeOutbound]; got != "18000" {
+		t.Errorf("unexpected outbound exclusions: %s", got)
+	}
+	if _, ok := pod.Annotations[linkerdSkipInbound]; ok {
+		t.Error("linkerd annotations should only be added when linkerd injects")
+	}
+
+	addMeshExclusions(pod, ns, []int{9091, 7000}, []int{18000})
+	if got := pod.Annotations[istioExcludeInbound]; got != "8080,7000,9091" {
+		t.Errorf("reinvocation should not duplicate exclusions: %s", got)
+	}
+}
+
+func TestAddMeshExclusionsLinkerd(t *testing.T) {
+	t.Parallel()
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{linkerdInjectAnnotation: "enabled"}, Labels: map[string]string{istioInjectLabel: "enabled"}}}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{istioInjectAnnotation: "false"}}}
+	addMeshExclusions(pod, ns, []int{9091}, []int{18000})
+	if pod.Annotations[linkerdSkipOutbound] != "18000" || pod.Annotations[linkerdSkipInbound] != "9091" {
+		t.Error("linkerd exclusions should be added")
+	}
+	if _, ok := pod.Annotations[istioExcludeOutbound]; ok {
+		t.Error("pods opting out of istio should not get istio exclusions")
+	}
+}
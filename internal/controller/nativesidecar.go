@@ -0,0 +1,200 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	// NativeSidecars injects quilkin as an init container with restartPolicy Always so it starts before
+	// the pod's containers and doesn't keep Jobs from completing
+	NativeSidecars = false
+	// nativeSidecarVersion is the first kubernetes version with native sidecars enabled by default
+	nativeSidecarVersion = version.MustParseGeneric("1.29.0")
+)
+
+// SupportsNativeSidecars returns whether the API server has native sidecars enabled by default
+func SupportsNativeSidecars(cfg *rest.Config) (bool, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return false, err
+	}
+	info, err := dc.ServerVersion()
+	if err != nil {
+		return false, err
+	}
+	v, err := version.ParseGeneric(info.GitVersion)
+	if err != nil {
+		return false, fmt.Errorf("parsing server version %q: %w", info.GitVersion, err)
+	}
+	return v.AtLeast(nativeSidecarVersion), nil
+}
+
+// setSidecar adds a quilkin container to the pod, as a native sidecar when enabled. An existing container
+// with the same name is replaced in place, or moved if it is in the wrong list for the injection mode.
+func setSidecar(pod *v1.Pod, container v1.Container) {
+	if NativeSidecars {
+		pod.Spec.Containers = removeContainer(pod.Spec.Containers, container.Name)
+		pod.Spec.InitContainers = setInitContainer(pod.Spec.InitContainers, container)
+		return
+	}
+	pod.Spec.InitContainers = removeContainer(pod.Spec.InitContainers, container.Name)
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == container.Name {
+			pod.Spec.Containers[i] = container
+			return
+		}
+	}
+	pod.Spec.Containers = append(pod.Spec.Containers, container)
+}
+
+// setInitContainer replaces the init container with the same name or runs the container provided first
+func setInitContainer(containers []v1.Container, container v1.Container) []v1.Container {
+	for i := range containers {
+		if containers[i].Name == container.Name {
+			containers[i] = container
+			return containers
+		}
+	}
+	return append([]v1.Container{container}, containers...)
+}
+
+// removeContainer removes the container with the name provided
+func removeContainer(containers []v1.Container, name string) []v1.Container {
+	kept := containers[:0]
+	for _, c := range containers {
+		if c.Name != name {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// markNativeSidecars sets restartPolicy Always on the quilkin init containers of the marshaled pod provided.
+// The vendored core/v1 types predate the field so it is added to the JSON directly.
+func markNativeSidecars(raw []byte, injected *v1.Pod) ([]byte, error) {
+	if !NativeSidecars {
+		return raw, nil
+	}
+	pod := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &pod); err != nil {
+		return nil, err
+	}
+	spec, _ := pod["spec"].(map[string]interface{})
+	initContainers, _ := spec["initContainers"].([]interface{})
+	for _, c := range initContainers {
+		container, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, _ := container["name"].(string); isSidecarContainer(injected, name) {
+			container["restartPolicy"] = "Always"
+		}
+	}
+	return json.Marshal(pod)
+}
+
+// injectedPodJSON marshals the injected pod for the admission patch. Fields of the original pod JSON the
+// vendored core/v1 types don't know, e.g. restartPolicy of native sidecars the pod already had, are carried
+// over so the patch doesn't remove them.
+func injectedPodJSON(original []byte, pod *v1.Pod) ([]byte, error) {
+	injected, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+	decoded := &v1.Pod{}
+	if err := json.Unmarshal(original, decoded); err != nil {
+		return nil, err
+	}
+	roundTripped, err := json.Marshal(decoded)
+	if err != nil {
+		return nil, err
+	}
+	var originalFields, knownFields, injectedFields interface{}
+	if err := json.Unmarshal(original, &originalFields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(roundTripped, &knownFields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(injected, &injectedFields); err != nil {
+		return nil, err
+	}
+	restoreUnknownFields(originalFields, knownFields, injectedFields)
+	injected, err = json.Marshal(injectedFields)
+	if err != nil {
+		return nil, err
+	}
+	return markNativeSidecars(injected, pod)
+}
+
+// restoreUnknownFields copies the fields of original missing from known into injected. Items of lists are
+// matched by name when they have one as injection adds and removes containers, volumes and env vars.
+func restoreUnknownFields(original interface{}, known interface{}, injected interface{}) {
+	switch o := original.(type) {
+	case map[string]interface{}:
+		k, _ := known.(map[string]interface{})
+		i, ok := injected.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, value := range o {
+			if knownValue, isKnown := k[key]; isKnown {
+				restoreUnknownFields(value, knownValue, i[key])
+			} else if _, set := i[key]; !set {
+				i[key] = value
+			}
+		}
+	case []interface{}:
+		k, _ := known.([]interface{})
+		i, ok := injected.([]interface{})
+		if !ok || len(k) != len(o) {
+			return
+		}
+		for index, value := range o {
+			if item := matchingItem(value, index, len(o), i); item != nil {
+				restoreUnknownFields(value, k[index], item)
+			}
+		}
+	}
+}
+
+// matchingItem returns the item of injected with the name of item, or the one at its index when
+// the items are unnamed and the list kept its length
+func matchingItem(item interface{}, index int, length int, injected []interface{}) interface{} {
+	named, _ := item.(map[string]interface{})
+	name, ok := named["name"].(string)
+	if !ok {
+		if len(injected) == length {
+			return injected[index]
+		}
+		return nil
+	}
+	for _, candidate := range injected {
+		if c, _ := candidate.(map[string]interface{}); c != nil && c["name"] == name {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// patchOnlyClient rejects pod updates like an API server does for native sidecars, as the core/v1 types
+// drop their restartPolicy
+type patchOnlyClient struct {
+	client.Client
+}
+
+func (c patchOnlyClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if _, ok := obj.(*corev1.Pod); ok {
+		return errors.New("pods must be patched")
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func TestNativeSidecarInjection(t *testing.T) {
+	NativeSidecars = true
+	defer func() { NativeSidecars = false }()
+
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "migrate"}},
+		Containers:     []corev1.Container{{Name: "game"}},
+	}}
+	setSidecar(pod, makeQuilkinContainer())
+	if len(pod.Spec.Containers) != 1 || pod.Spec.InitContainers[0].Name != "quilkin" {
+		t.Fatal("quilkin should be the first init container")
+	}
+
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err = markNativeSidecars(raw, pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(raw), `"restartPolicy":"Always"`) != 1 {
+		t.Errorf("only the quilkin init container should restart: %s", raw)
+	}
+}
+
+func TestNativeSidecarInjectionKeepsExistingSidecars(t *testing.T) {
+	NativeSidecars = true
+	defer func() { NativeSidecars = false }()
+
+	raw := []byte(`{
+		"apiVersion": "v1",
+		"kind": "Pod",
+		"metadata": {"name": "client", "namespace": "games", "annotations": {"` + SenderAnnotation + `": "server"}},
+		"spec": {
+			"initContainers": [{"name": "log-shipper", "image": "shipper", "restartPolicy": "Always"}],
+			"containers": [{"name": "game", "image": "game"}]
+		}
+	}`)
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "games"}}
+	q := NewQuilkinAnnotationReader(newFakeClient(ns), zap.NewNop().Sugar(), nil)
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(raw, pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.injectPod(context.Background(), ns, pod); err != nil {
+		t.Fatal(err)
+	}
+	injected, err := injectedPodJSON(raw, pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := struct {
+		Spec struct {
+			InitContainers []struct {
+				Name          string `json:"name"`
+				RestartPolicy string `json:"restartPolicy"`
+			} `json:"initContainers"`
+		} `json:"spec"`
+	}{}
+	if err := json.Unmarshal(injected, &fields); err != nil {
+		t.Fatal(err)
+	}
+	initContainers := fields.Spec.InitContainers
+	if len(initContainers) != 2 || initContainers[0].Name != "quilkin" || initContainers[1].Name != "log-shipper" {
+		t.Fatalf("quilkin should run before the existing sidecar: %v", initContainers)
+	}
+	for _, c := range initContainers {
+		if c.RestartPolicy != "Always" {
+			t.Errorf("%s should be a native sidecar: %s", c.Name, injected)
+		}
+	}
+}
+
+func TestFinalizerRemovalPatchesPod(t *testing.T) {
+	ctx := context.Background()
+	now := metav1.Now()
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "client",
+			Namespace:         "games",
+			Annotations:       map[string]string{SenderAnnotation: "server"},
+			Finalizers:        []string{Finalizer},
+			DeletionTimestamp: &now,
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "game"}}},
+	}
+	c := patchOnlyClient{newFakeClient(pod)}
+	s := store.NewSotWStore(make(chan store.NodeConfig, 10), make(chan string, 10), zap.NewNop().Sugar())
+	r := NewQuilkinReconciler(c, zap.NewNop().Sugar(), s)
+	result, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(pod)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Requeue {
+		t.Fatal("the finalizer should be removed without updating the pod")
+	}
+	// The pod is gone once its last finalizer is removed
+	if err := c.Get(ctx, client.ObjectKeyFromObject(pod), &corev1.Pod{}); !apierrors.IsNotFound(err) {
+		t.Errorf("the quilkin finalizer should be removed: %v", err)
+	}
+}
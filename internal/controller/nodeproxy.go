@@ -0,0 +1,253 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nfowl/quilkin-controller/internal/quilkin"
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// NodeProxyName is the name of the DaemonSet and ConfigMap making up the node local proxies
+	NodeProxyName = "quilkin-node-proxy"
+	// nodeProxyComponent is the ComponentLabel value of node proxy objects
+	nodeProxyComponent = "node-proxy"
+	// nodeNamePlaceholder is replaced with the node name when the node proxy config is rendered
+	nodeNamePlaceholder = "__NODE_NAME__"
+)
+
+var (
+	// NodeProxyInitImage is the image used to render the node proxy config. It must contain sh and sed.
+	NodeProxyInitImage = "busybox:1.33"
+	// NodeProxyPorts is the host port of the node local proxy of each proxy senders may use in NodeProxyMode
+	NodeProxyPorts = map[string]int{}
+)
+
+// ParseNodeProxyPorts parses a comma separated list of proxy=port pairs into the node proxy port of each proxy
+func ParseNodeProxyPorts(value string) (map[string]int, error) {
+	ports := make(map[string]int)
+	if strings.TrimSpace(value) == "" {
+		return ports, nil
+	}
+	proxies := make(map[int]string)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not a proxy=port pair", pair)
+		}
+		name := parts[0]
+		if errs := validation.IsDNS1123Label(nodeProxyContainerName(name)); len(errs) > 0 {
+			return nil, fmt.Errorf("%q is not a valid proxy name: %s", name, strings.Join(errs, ", "))
+		}
+		port, err := strconv.Atoi(parts[1])
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("%q is not a valid port for proxy %s", parts[1], name)
+		}
+		if _, ok := ports[name]; ok {
+			return nil, fmt.Errorf("proxy %s is listed more than once", name)
+		}
+		if other, ok := proxies[port]; ok {
+			return nil, fmt.Errorf("proxies %s and %s both use port %d", other, name, port)
+		}
+		ports[name] = port
+		proxies[port] = name
+	}
+	return ports, nil
+}
+
+// nodeProxyContainerName returns the name of the container running the node local proxy of a proxy
+func nodeProxyContainerName(proxyName string) string {
+	return "quilkin-" + proxyName
+}
+
+// nodeProxyNames returns the proxies in NodeProxyPorts in a stable order
+func nodeProxyNames() []string {
+	names := make([]string, 0, len(NodeProxyPorts))
+	for name := range NodeProxyPorts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// nodeProxyAdminPorts assigns each node local proxy an admin port counting up from quilkinAdminPort,
+// skipping the ports of the proxies as the containers share the network namespace of the pod.
+func nodeProxyAdminPorts(names []string) map[string]int {
+	used := make(map[int]bool, len(NodeProxyPorts))
+	for _, port := range NodeProxyPorts {
+		used[port] = true
+	}
+	ports := make(map[string]int, len(names))
+	port := quilkinAdminPort
+	for _, name := range names {
+		for used[port] {
+			port++
+		}
+		ports[name] = port
+		used[port] = true
+	}
+	return ports
+}
+
+// NodeProxyReconciler keeps the DaemonSet running the node local proxies for NodeProxyMode, and its ConfigMap,
+// in line with NodeProxyPorts. Every node runs a quilkin container per proxy listening on the host port of the
+// proxy and identifying itself to the xds server as store.NodeProxyID of its node and proxy.
+type NodeProxyReconciler struct {
+	client    client.Client
+	logger    *zap.SugaredLogger
+	namespace string
+}
+
+// NewNodeProxyReconciler constructs a new NodeProxyReconciler struct from the passed arguments.
+// The DaemonSet is created in the namespace provided.
+func NewNodeProxyReconciler(c client.Client, l *zap.SugaredLogger, namespace string) *NodeProxyReconciler {
+	return &NodeProxyReconciler{
+		client:    c,
+		logger:    l,
+		namespace: namespace,
+	}
+}
+
+// SetupWithManager registers the reconciler with the manager. The node proxy is reconciled on start
+// and whenever its DaemonSet or ConfigMap change.
+func (n *NodeProxyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	nodeProxy := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return obj.GetNamespace() == n.namespace && obj.GetName() == NodeProxyName
+	})
+	start := source.Func(func(_ context.Context, _ handler.EventHandler, q workqueue.RateLimitingInterface, _ ...predicate.Predicate) error {
+		q.Add(n.request())
+		return nil
+	})
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("node-proxy").
+		For(&appsv1.DaemonSet{}, builder.WithPredicates(nodeProxy)).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(nodeProxy)).
+		Watches(start, &handler.EnqueueRequestForObject{}).
+		Complete(n)
+}
+
+// request returns the request every node proxy event is reconciled as
+func (n *NodeProxyReconciler) request() reconcile.Request {
+	return reconcile.Request{NamespacedName: types.NamespacedName{Namespace: n.namespace, Name: NodeProxyName}}
+}
+
+// Reconcile creates or updates the node proxy ConfigMap and DaemonSet
+func (n *NodeProxyReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	version, err := DefaultQuilkinVersion()
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	names := nodeProxyNames()
+	adminPorts := nodeProxyAdminPorts(names)
+	data := make(map[string]string, len(names))
+	for _, name := range names {
+		config := quilkin.NewQuilkinConfig(store.NodeProxyID(nodeNamePlaceholder, name))
+		config.Proxy.Port = NodeProxyPorts[name]
+		config.Admin.Address = "[::]:" + strconv.Itoa(adminPorts[name])
+		conf, err := quilkin.Render(config, version)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		data[name+".yaml"] = string(conf)
+	}
+	labels := map[string]string{ManagedByLabel: ManagedByValue, ComponentLabel: nodeProxyComponent}
+
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: n.namespace, Name: NodeProxyName}}
+	result, err := controllerutil.CreateOrUpdate(ctx, n.client, cm, func() error {
+		cm.Labels = labels
+		cm.Data = data
+		return nil
+	})
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if result != controllerutil.OperationResultNone {
+		n.logger.Infow("Reconciled node proxy configmap", "namespace", n.namespace, "result", result)
+	}
+
+	ds := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: n.namespace, Name: NodeProxyName}}
+	result, err = controllerutil.CreateOrUpdate(ctx, n.client, ds, func() error {
+		ds.Labels = labels
+		if ds.CreationTimestamp.IsZero() {
+			ds.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+		}
+		podLabels := map[string]string{ManagedByLabel: ManagedByValue, ComponentLabel: nodeProxyComponent, "nfowler.dev/quilkin": "disabled"}
+		ds.Spec.Template.Labels = podLabels
+
+		// The configs are shared by every node so the node name is substituted in before quilkin starts.
+		// Each proxy gets its own directory as quilkin reads quilkin.yaml from its config directory.
+		render := corev1.Container{
+			Name:    "render-config",
+			Image:   NodeProxyInitImage,
+			Command: []string{"sh", "-c", "for f in /etc/quilkin-template/*.yaml; do p=$(basename \"$f\" .yaml); mkdir -p /etc/quilkin/$p; sed \"s|" + nodeNamePlaceholder + "|$NODE_NAME|\" \"$f\" > /etc/quilkin/$p/quilkin.yaml; done"},
+			Env:     []corev1.EnvVar{{Name: "NODE_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"}}}},
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: "quilkin-template", MountPath: "/etc/quilkin-template", ReadOnly: true},
+				{Name: "quilkin-config", MountPath: "/etc/quilkin"},
+			},
+		}
+		containers := make([]corev1.Container, 0, len(names))
+		for i, name := range names {
+			port := int32(NodeProxyPorts[name])
+			container := makeQuilkinContainer()
+			container.Name = nodeProxyContainerName(name)
+			container.VolumeMounts[0].Name = "quilkin-config"
+			container.VolumeMounts[0].SubPath = name
+			container.ReadinessProbe = makeAdminProbe(adminPorts[name])
+			container.Ports = []corev1.ContainerPort{
+				{Name: "admin-" + strconv.Itoa(i), ContainerPort: int32(adminPorts[name]), Protocol: corev1.ProtocolTCP},
+				{Name: "udp-proxy-" + strconv.Itoa(i), ContainerPort: port, HostPort: port, Protocol: corev1.ProtocolUDP},
+			}
+			containers = append(containers, container)
+		}
+		ds.Spec.Template.Spec.InitContainers = []corev1.Container{render}
+		ds.Spec.Template.Spec.Containers = containers
+		ds.Spec.Template.Spec.Volumes = []corev1.Volume{
+			{Name: "quilkin-template", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: NodeProxyName}}}},
+			{Name: "quilkin-config", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		}
+		return nil
+	})
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if result != controllerutil.OperationResultNone {
+		n.logger.Infow("Reconciled node proxy daemonset", "namespace", n.namespace, "result", result)
+	}
+	return reconcile.Result{}, nil
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestParseNodeProxyPorts(t *testing.T) {
+	ports, err := ParseNodeProxyPorts("server=7000, chat=7001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 2 || ports["server"] != 7000 || ports["chat"] != 7001 {
+		t.Errorf("unexpected ports %v", ports)
+	}
+	for _, value := range []string{"server", "server=0", "server=7000,server=7001", "server=7000,chat=7000", "Server=7000"} {
+		if _, err := ParseNodeProxyPorts(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestNodeProxyReconcile(t *testing.T) {
+	defer func(ports map[string]int) { NodeProxyPorts = ports }(NodeProxyPorts)
+	NodeProxyPorts = map[string]int{"server": 7000, "chat": 9091}
+	ctx := context.Background()
+	c := newFakeClient()
+	n := NewNodeProxyReconciler(c, zap.NewNop().Sugar(), "quilkin")
+	if _, err := n.Reconcile(ctx, n.request()); err != nil {
+		t.Fatal(err)
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := c.Get(ctx, n.request().NamespacedName, cm); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cm.Data["chat.yaml"], "id: node/__NODE_NAME__/chat") || !strings.Contains(cm.Data["chat.yaml"], "port: 9091") {
+		t.Errorf("unexpected chat config:\n%s", cm.Data["chat.yaml"])
+	}
+	if !strings.Contains(cm.Data["server.yaml"], "id: node/__NODE_NAME__/server") || !strings.Contains(cm.Data["server.yaml"], "port: 7000") {
+		t.Errorf("unexpected server config:\n%s", cm.Data["server.yaml"])
+	}
+
+	ds := &appsv1.DaemonSet{}
+	if err := c.Get(ctx, n.request().NamespacedName, ds); err != nil {
+		t.Fatal(err)
+	}
+	containers := ds.Spec.Template.Spec.Containers
+	if len(containers) != 2 || containers[0].Name != "quilkin-chat" || containers[1].Name != "quilkin-server" {
+		t.Fatalf("expected a container per proxy: %v", containers)
+	}
+	// The chat proxy takes the default admin port so both admin ports move past it
+	if containers[0].Ports[0].ContainerPort != 9092 || containers[0].Ports[1].HostPort != 9091 || containers[0].VolumeMounts[0].SubPath != "chat" {
+		t.Errorf("unexpected chat container %v", containers[0])
+	}
+	if containers[1].Ports[0].ContainerPort != 9093 || containers[1].Ports[1].HostPort != 7000 {
+		t.Errorf("unexpected server container %v", containers[1])
+	}
+
+	// Drift is reverted and a deleted DaemonSet is recreated
+	ds.Spec.Template.Spec.Containers = ds.Spec.Template.Spec.Containers[:1]
+	if err := c.Update(ctx, ds); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Reconcile(ctx, n.request()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, n.request().NamespacedName, ds); err != nil {
+		t.Fatal(err)
+	}
+	if len(ds.Spec.Template.Spec.Containers) != 2 {
+		t.Error("the daemonset should be reconciled back to a container per proxy")
+	}
+	if err := c.Delete(ctx, ds); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Reconcile(ctx, n.request()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, n.request().NamespacedName, &appsv1.DaemonSet{}); err != nil {
+		t.Errorf("the daemonset should be recreated: %v", err)
+	}
+}
+
+func TestInjectPodNodeProxy(t *testing.T) {
+	defer func(mode string, ports map[string]int) { ProxyMode, NodeProxyPorts = mode, ports }(ProxyMode, NodeProxyPorts)
+	ProxyMode = NodeProxyMode
+	NodeProxyPorts = map[string]int{"server": 7000, "chat": 7001}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "games"}}
+	q := NewQuilkinAnnotationReader(newFakeClient(ns), zap.NewNop().Sugar(), nil)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: "games", Annotations: map[string]string{SenderAnnotation: "chat,server"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "game", Image: "game"}}},
+	}
+	if err := q.injectPod(context.Background(), ns, pod); err != nil {
+		t.Fatal(err)
+	}
+	if len(pod.Spec.Containers) != 1 {
+		t.Errorf("no sidecar should be injected in node proxy mode: %v", pod.Spec.Containers)
+	}
+	env := map[string]string{}
+	for _, e := range pod.Spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	if env[ProxyPortEnv] != "7001" || env[proxyPortEnv("chat")] != "7001" || env[proxyPortEnv("server")] != "7000" {
+		t.Errorf("each proxy should be exposed with its node proxy port, got %v", env)
+	}
+
+	pod.Annotations[SenderAnnotation] = "unknown"
+	if err := q.injectPod(context.Background(), ns, pod); err == nil {
+		t.Error("senders of proxies without a node proxy port should be rejected")
+	}
+}
+
+func TestNodeSendersKeyedByNamespace(t *testing.T) {
+	defer func(mode string) { ProxyMode = mode }(ProxyMode)
+	ProxyMode = NodeProxyMode
+	ctx := context.Background()
+	pods := make([]*corev1.Pod, 0, 2)
+	for _, namespace := range []string{"games", "other"} {
+		pods = append(pods, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "client", Annotations: map[string]string{SenderAnnotation: "server"}, Finalizers: []string{Finalizer}},
+			Spec:       corev1.PodSpec{NodeName: "node-a", Containers: []corev1.Container{{Name: "game"}}},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.5"},
+		})
+	}
+	c := newFakeClient(pods[0], pods[1])
+	updates := make(chan store.NodeConfig, 100)
+	s := store.NewSotWStore(updates, make(chan string, 100), zap.NewNop().Sugar())
+	r := NewQuilkinReconciler(c, zap.NewNop().Sugar(), s)
+	for _, pod := range pods {
+		if _, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(pod)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Removing the sender of one namespace keeps the node proxy of the other
+	if err := c.Delete(ctx, pods[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(pods[0])}); err != nil {
+		t.Fatal(err)
+	}
+	for len(updates) > 0 {
+		<-updates
+	}
+	s.AddReceiver("server", 7777, "10.0.0.2", "games/server-0")
+	for len(updates) > 0 {
+		if update := <-updates; update.ProxyName == store.NodeProxyID("node-a", "server") {
+			return
+		}
+	}
+	t.Error("the node proxy should still be served to the remaining sender")
+}
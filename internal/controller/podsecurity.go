@@ -0,0 +1,109 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// PodSecurityEnforceLabel is the namespace label holding the Pod Security Admission level enforced on its pods
+	PodSecurityEnforceLabel = "pod-security.kubernetes.io/enforce"
+	// PodSecurityRestricted is the most restrictive Pod Security Admission level
+	PodSecurityRestricted = "restricted"
+	// PodSecurityBaseline is the Pod Security Admission level preventing known privilege escalations
+	PodSecurityBaseline = "baseline"
+	// sidecarUser is the non root user the quilkin container runs as when it needs one
+	sidecarUser = 65534
+)
+
+// podSecurityLevel returns the Pod Security Admission level enforced in the namespace provided
+func podSecurityLevel(ns *corev1.Namespace) string {
+	return ns.Labels[PodSecurityEnforceLabel]
+}
+
+// restrictContainer sets the securityContext fields the restricted level requires on a quilkin container.
+// Fields the template already set are kept and an error describes any that the restricted level rejects,
+// along with pod level settings that would make the container non compliant.
+func restrictContainer(pod *corev1.Pod, container *corev1.Container) error {
+	if psc := pod.Spec.SecurityContext; psc != nil {
+		if psc.RunAsUser != nil && *psc.RunAsUser == 0 {
+			return fmt.Errorf("pod securityContext runs as root which the restricted pod security level forbids")
+		}
+	}
+
+	if container.SecurityContext == nil {
+		container.SecurityContext = &corev1.SecurityContext{}
+	}
+	sc := container.SecurityContext
+	switch {
+	case sc.Privileged != nil && *sc.Privileged:
+		return fmt.Errorf("sidecar template sets privileged which the restricted pod security level forbids")
+	case sc.AllowPrivilegeEscalation != nil && *sc.AllowPrivilegeEscalation:
+		return fmt.Errorf("sidecar template allows privilege escalation which the restricted pod security level forbids")
+	case sc.RunAsNonRoot != nil && !*sc.RunAsNonRoot:
+		return fmt.Errorf("sidecar template sets runAsNonRoot to false which the restricted pod security level forbids")
+	case sc.RunAsUser != nil && *sc.RunAsUser == 0:
+		return fmt.Errorf("sidecar template runs as root which the restricted pod security level forbids")
+	case sc.SeccompProfile != nil && sc.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined:
+		return fmt.Errorf("sidecar template sets an Unconfined seccomp profile which the restricted pod security level forbids")
+	}
+	if sc.Capabilities != nil {
+		for _, c := range sc.Capabilities.Add {
+			if c != "NET_BIND_SERVICE" {
+				return fmt.Errorf("sidecar template adds capability %s which the restricted pod security level forbids", c)
+			}
+		}
+	}
+
+	f := false
+	t := true
+	if sc.AllowPrivilegeEscalation == nil {
+		sc.AllowPrivilegeEscalation = &f
+	}
+	if sc.RunAsNonRoot == nil {
+		sc.RunAsNonRoot = &t
+	}
+	// The quilkin image runs as root so a user is needed for runAsNonRoot to pass kubelet checks
+	if sc.RunAsUser == nil && (pod.Spec.SecurityContext == nil || pod.Spec.SecurityContext.RunAsUser == nil) {
+		user := int64(sidecarUser)
+		sc.RunAsUser = &user
+	}
+	if sc.Capabilities == nil {
+		sc.Capabilities = &corev1.Capabilities{}
+	}
+	if !containsCapability(sc.Capabilities.Drop, "ALL") {
+		sc.Capabilities.Drop = append(sc.Capabilities.Drop, "ALL")
+	}
+	if sc.SeccompProfile == nil && (pod.Spec.SecurityContext == nil || pod.Spec.SecurityContext.SeccompProfile == nil ||
+		pod.Spec.SecurityContext.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined) {
+		sc.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+	}
+	return nil
+}
+
+// containsCapability returns whether the capability is in the list provided
+func containsCapability(capabilities []corev1.Capability, capability corev1.Capability) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
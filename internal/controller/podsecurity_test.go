@@ -0,0 +1,58 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestRestrictContainerDefaults(t *testing.T) {
+	t.Parallel()
+	pod := &corev1.Pod{}
+	container := makeQuilkinContainer()
+	if err := restrictContainer(pod, &container); err != nil {
+		t.Fatal(err)
+	}
+	sc := container.SecurityContext
+	if *sc.AllowPrivilegeEscalation || !*sc.RunAsNonRoot || *sc.RunAsUser == 0 {
+		t.Error("container should run as non root without privilege escalation")
+	}
+	if len(sc.Capabilities.Drop) != 1 || sc.Capabilities.Drop[0] != "ALL" {
+		t.Error("all capabilities should be dropped")
+	}
+	if sc.SeccompProfile == nil || sc.SeccompProfile.Type != corev1.SeccompProfileTypeRuntimeDefault {
+		t.Error("seccomp profile should be RuntimeDefault")
+	}
+}
+
+func TestRestrictContainerConflicts(t *testing.T) {
+	t.Parallel()
+	root := int64(0)
+	pod := &corev1.Pod{Spec: corev1.PodSpec{SecurityContext: &corev1.PodSecurityContext{RunAsUser: &root}}}
+	container := makeQuilkinContainer()
+	if err := restrictContainer(pod, &container); err == nil {
+		t.Error("pods running as root should be rejected")
+	}
+
+	container = makeQuilkinContainer()
+	container.SecurityContext = &corev1.SecurityContext{Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_ADMIN"}}}
+	if err := restrictContainer(&corev1.Pod{}, &container); err == nil {
+		t.Error("templates adding capabilities should be rejected")
+	}
+}
@@ -0,0 +1,472 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nfowl/quilkin-controller/api/v1alpha1"
+	"github.com/nfowl/quilkin-controller/internal/quilkin"
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// DefaultGatewayPort is the UDP port gateway Services listen on when not set
+	DefaultGatewayPort = 7000
+	// ComponentLabel is the label key describing what part of a proxy an object belongs to
+	ComponentLabel = "app.kubernetes.io/component"
+	// gatewayComponent is the ComponentLabel value of gateway objects
+	gatewayComponent = "gateway"
+	// proxyPortName is the name of the UDP port quilkin listens on
+	proxyPortName = "udp-proxy"
+	// quilkinProxyPort is the port quilkin listens on for traffic
+	quilkinProxyPort = 7000
+)
+
+// ProxyReconciler manages the objects belonging to a Proxy.
+// When the proxy has a gateway configured a quilkin Deployment, Service and ConfigMap are created and owned by it.
+// The filter chains of the proxy are pushed to the store.
+type ProxyReconciler struct {
+	client client.Client
+	logger *zap.SugaredLogger
+	store  *store.SotwStore
+}
+
+// NewProxyReconciler constructs a new ProxyReconciler struct from the passed arguments
+func NewProxyReconciler(c client.Client, l *zap.SugaredLogger, s *store.SotwStore) *ProxyReconciler {
+	return &ProxyReconciler{
+		client: c,
+		logger: l,
+		store:  s,
+	}
+}
+
+// SetupWithManager registers the reconciler and the watches on owned objects with the manager
+func (p *ProxyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.Proxy{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&corev1.Service{}).
+		Owns(&corev1.ConfigMap{}).
+		Watches(&source.Kind{Type: &corev1.Namespace{}}, handler.EnqueueRequestsFromMapFunc(p.namespaceProxies)).
+		Watches(&source.Kind{Type: &v1alpha1.Proxy{}}, handler.EnqueueRequestsFromMapFunc(p.sameNamedProxies)).
+		Complete(p)
+}
+
+// sameNamedProxies maps a proxy to the proxies of the same name in other namespaces so one takes over the name
+// once its owner is deleted
+func (p *ProxyReconciler) sameNamedProxies(obj client.Object) []reconcile.Request {
+	proxies := &v1alpha1.ProxyList{}
+	if err := p.client.List(context.Background(), proxies); err != nil {
+		p.logger.Errorw("Failed to list proxies", "error", err)
+		return nil
+	}
+	requests := make([]reconcile.Request, 0)
+	for _, proxy := range proxies.Items {
+		if proxy.Name == obj.GetName() && proxy.Namespace != obj.GetNamespace() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: proxy.Namespace, Name: proxy.Name}})
+		}
+	}
+	return requests
+}
+
+// namespaceProxies maps a namespace to the proxies in it so namespace filter defaults are applied
+func (p *ProxyReconciler) namespaceProxies(obj client.Object) []reconcile.Request {
+	proxies := &v1alpha1.ProxyList{}
+	if err := p.client.List(context.Background(), proxies, client.InNamespace(obj.GetName())); err != nil {
+		p.logger.Errorw("Failed to list proxies", "namespace", obj.GetName(), "error", err)
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(proxies.Items))
+	for _, proxy := range proxies.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: proxy.Namespace, Name: proxy.Name}})
+	}
+	return requests
+}
+
+// Reconcile ensures the gateway objects of the proxy match its spec
+func (p *ProxyReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	proxy := &v1alpha1.Proxy{}
+	if err := p.client.Get(ctx, req.NamespacedName, proxy); err != nil {
+		if apierrors.IsNotFound(err) {
+			return reconcile.Result{}, p.releaseName(ctx, req.Name)
+		}
+		return reconcile.Result{}, err
+	}
+	if !proxy.DeletionTimestamp.IsZero() {
+		// Owned objects are garbage collected by kubernetes
+		return reconcile.Result{}, p.releaseName(ctx, proxy.Name)
+	}
+
+	owner, err := proxyNameOwner(ctx, p.client, proxy.Name)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if owner != nil && owner.Namespace != proxy.Namespace {
+		// The store is keyed by proxy name, so only one Proxy of a name may configure it
+		p.logger.Warnw("Ignoring proxy whose name is used in another namespace", "proxy", proxy.Name, "namespace", proxy.Namespace, "owner", owner.Namespace)
+		if err := p.deleteGateway(ctx, proxy); err != nil {
+			return reconcile.Result{}, err
+		}
+		return reconcile.Result{}, p.updateStatus(ctx, proxy, v1alpha1.ProxyStatus{Conflict: owner.Namespace + "/" + owner.Name})
+	}
+
+	ns := &corev1.Namespace{}
+	if err := p.client.Get(ctx, client.ObjectKey{Name: proxy.Namespace}, ns); err != nil {
+		return reconcile.Result{}, err
+	}
+	filters, err := makeProxyFilters(proxy, ns)
+	if err != nil {
+		p.logger.Errorw("Invalid proxy filters", "proxy", proxy.Name, "namespace", proxy.Namespace, "error", err)
+		return reconcile.Result{}, err
+	}
+	if err := checkProxyVersions(proxy, filters); err != nil {
+		p.logger.Errorw("Proxy filters not supported by its quilkin version", "proxy", proxy.Name, "namespace", proxy.Namespace, "error", err)
+		return reconcile.Result{}, err
+	}
+	p.store.SetFilters(proxy.Name, filters)
+
+	if proxy.Spec.Gateway == nil {
+		if err := p.deleteGateway(ctx, proxy); err != nil {
+			return reconcile.Result{}, err
+		}
+		return reconcile.Result{}, p.updateStatus(ctx, proxy, v1alpha1.ProxyStatus{})
+	}
+
+	if err := p.ensureGatewayConfig(ctx, proxy); err != nil {
+		return reconcile.Result{}, err
+	}
+	deployment, err := p.ensureGatewayDeployment(ctx, proxy)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	svc, err := p.ensureGatewayService(ctx, proxy)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{}, p.updateStatus(ctx, proxy, v1alpha1.ProxyStatus{
+		ReadyReplicas: deployment.Status.ReadyReplicas,
+		Addresses:     serviceAddresses(svc),
+	})
+}
+
+// proxyNameOwner returns the Proxy that uses the name provided, or nil if there is none. Proxy names are the
+// node ids of their proxies, so when several namespaces have a Proxy of the same name the oldest one owns it.
+func proxyNameOwner(ctx context.Context, c client.Client, name string) (*v1alpha1.Proxy, error) {
+	proxies := &v1alpha1.ProxyList{}
+	if err := c.List(ctx, proxies); err != nil {
+		return nil, err
+	}
+	var owner *v1alpha1.Proxy
+	for i := range proxies.Items {
+		proxy := &proxies.Items[i]
+		if proxy.Name != name || !proxy.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if owner == nil || proxy.CreationTimestamp.Before(&owner.CreationTimestamp) ||
+			(proxy.CreationTimestamp.Equal(&owner.CreationTimestamp) && proxy.Namespace < owner.Namespace) {
+			owner = proxy
+		}
+	}
+	return owner, nil
+}
+
+// releaseName clears the filters of a deleted proxy unless another Proxy of the same name remains.
+// That one takes over the name when it is reconciled.
+func (p *ProxyReconciler) releaseName(ctx context.Context, name string) error {
+	owner, err := proxyNameOwner(ctx, p.client, name)
+	if err != nil {
+		return err
+	}
+	if owner == nil {
+		p.store.SetFilters(name, store.ProxyFilters{})
+	}
+	return nil
+}
+
+// ensureGatewayConfig creates or updates the quilkin config used by the gateway
+func (p *ProxyReconciler) ensureGatewayConfig(ctx context.Context, proxy *v1alpha1.Proxy) error {
+	version, err := gatewayQuilkinVersion(proxy.Spec.Gateway)
+	if err != nil {
+		return err
+	}
+	conf, err := quilkin.Render(quilkin.NewQuilkinConfig(proxy.Name), version)
+	if err != nil {
+		return err
+	}
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: proxy.Namespace, Name: gatewayName(proxy)}}
+	_, err = controllerutil.CreateOrUpdate(ctx, p.client, cm, func() error {
+		cm.Labels = gatewayLabels(proxy)
+		cm.Data = map[string]string{"quilkin.yaml": string(conf)}
+		return controllerutil.SetControllerReference(proxy, cm, p.client.Scheme())
+	})
+	return err
+}
+
+// gatewayQuilkinVersion returns the quilkin version of the image a gateway runs
+func gatewayQuilkinVersion(gateway *v1alpha1.GatewaySpec) (string, error) {
+	if gateway.Image == "" && gateway.Version == "" {
+		return DefaultQuilkinVersion()
+	}
+	image := gateway.Image
+	if image == "" {
+		image = QuilkinImage
+	}
+	return checkQuilkinVersion(image, gateway.Version)
+}
+
+// ensureGatewayDeployment creates or updates the quilkin Deployment of the gateway
+func (p *ProxyReconciler) ensureGatewayDeployment(ctx context.Context, proxy *v1alpha1.Proxy) (*appsv1.Deployment, error) {
+	gateway := proxy.Spec.Gateway
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: proxy.Namespace, Name: gatewayName(proxy)}}
+	_, err := controllerutil.CreateOrUpdate(ctx, p.client, deployment, func() error {
+		labels := gatewayLabels(proxy)
+		deployment.Labels = labels
+		replicas := int32(1)
+		if gateway.Replicas != nil {
+			replicas = *gateway.Replicas
+		}
+		deployment.Spec.Replicas = &replicas
+		if deployment.CreationTimestamp.IsZero() {
+			deployment.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+		}
+
+		container := makeQuilkinContainer()
+		if gateway.Image != "" {
+			container.Image = gateway.Image
+		}
+		container.Resources = gateway.Resources
+		container.Ports = append(container.Ports, corev1.ContainerPort{Name: proxyPortName, ContainerPort: quilkinProxyPort, Protocol: corev1.ProtocolUDP})
+
+		podLabels := gatewayLabels(proxy)
+		// Gateway pods must never be mutated by the injection webhook
+		podLabels["nfowler.dev/quilkin"] = "disabled"
+		deployment.Spec.Template.Labels = podLabels
+		deployment.Spec.Template.Spec.Containers = []corev1.Container{container}
+		deployment.Spec.Template.Spec.Volumes = []corev1.Volume{{
+			Name:         "quilkin-config",
+			VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: gatewayName(proxy)}}},
+		}}
+		return controllerutil.SetControllerReference(proxy, deployment, p.client.Scheme())
+	})
+	return deployment, err
+}
+
+// ensureGatewayService creates or updates the UDP Service in front of the gateway
+func (p *ProxyReconciler) ensureGatewayService(ctx context.Context, proxy *v1alpha1.Proxy) (*corev1.Service, error) {
+	gateway := proxy.Spec.Gateway
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: proxy.Namespace, Name: gatewayName(proxy)}}
+	_, err := controllerutil.CreateOrUpdate(ctx, p.client, svc, func() error {
+		svc.Labels = gatewayLabels(proxy)
+		svc.Annotations = gateway.ServiceAnnotations
+		svc.Spec.Type = gateway.ServiceType
+		if svc.Spec.Type == "" {
+			svc.Spec.Type = corev1.ServiceTypeClusterIP
+		}
+		svc.Spec.Selector = gatewayLabels(proxy)
+		port := corev1.ServicePort{Name: proxyPortName, Port: gateway.Port, TargetPort: intstr.FromString(proxyPortName), Protocol: corev1.ProtocolUDP}
+		if port.Port == 0 {
+			port.Port = DefaultGatewayPort
+		}
+		// Keep the allocated node port so updates don't move it
+		if len(svc.Spec.Ports) == 1 && svc.Spec.Type != corev1.ServiceTypeClusterIP {
+			port.NodePort = svc.Spec.Ports[0].NodePort
+		}
+		svc.Spec.Ports = []corev1.ServicePort{port}
+		return controllerutil.SetControllerReference(proxy, svc, p.client.Scheme())
+	})
+	return svc, err
+}
+
+// deleteGateway removes any gateway objects owned by the proxy
+func (p *ProxyReconciler) deleteGateway(ctx context.Context, proxy *v1alpha1.Proxy) error {
+	key := types.NamespacedName{Namespace: proxy.Namespace, Name: gatewayName(proxy)}
+	for _, obj := range []client.Object{&appsv1.Deployment{}, &corev1.Service{}, &corev1.ConfigMap{}} {
+		if err := p.client.Get(ctx, key, obj); err != nil {
+			if client.IgnoreNotFound(err) != nil {
+				return err
+			}
+			continue
+		}
+		if !metav1.IsControlledBy(obj, proxy) {
+			continue
+		}
+		p.logger.Infow("Deleting gateway object", "proxy", proxy.Name, "namespace", proxy.Namespace, "name", key.Name)
+		if err := p.client.Delete(ctx, obj); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateStatus writes the status provided if it differs from the current one
+func (p *ProxyReconciler) updateStatus(ctx context.Context, proxy *v1alpha1.Proxy, status v1alpha1.ProxyStatus) error {
+	if equality.Semantic.DeepEqual(proxy.Status, status) {
+		return nil
+	}
+	proxy.Status = status
+	return p.client.Status().Update(ctx, proxy)
+}
+
+// checkProxyVersions returns an error if the quilkin version injected by default, or the version of the gateway,
+// lacks a filter of the proxy. Pods injected with another version are checked by the webhook.
+func checkProxyVersions(proxy *v1alpha1.Proxy, filters store.ProxyFilters) error {
+	version, err := DefaultQuilkinVersion()
+	if err != nil {
+		return err
+	}
+	if err := checkFilterVersions(filters, version, version); err != nil {
+		return err
+	}
+	if proxy.Spec.Gateway == nil {
+		return nil
+	}
+	if version, err = gatewayQuilkinVersion(proxy.Spec.Gateway); err != nil {
+		return err
+	}
+	if err := checkFilterVersions(filters, version, ""); err != nil {
+		return fmt.Errorf("gateway: %w", err)
+	}
+	return nil
+}
+
+// checkFilterVersions returns an error if the quilkin version of the sender or receiver side proxies provided
+// lacks a filter they would be served. Empty versions aren't checked.
+func checkFilterVersions(filters store.ProxyFilters, senderVersion string, receiverVersion string) error {
+	if senderVersion != "" {
+		if err := quilkin.CheckFilters(filters.Sender, senderVersion); err != nil {
+			return fmt.Errorf("filters: %w", err)
+		}
+	}
+	if receiverVersion != "" {
+		receiver := filters.Receiver
+		if filters.Firewall != nil {
+			receiver = append([]quilkin.Filter{&quilkin.Firewall{}}, receiver...)
+		}
+		if err := quilkin.CheckFilters(receiver, receiverVersion); err != nil {
+			return fmt.Errorf("receiverFilters: %w", err)
+		}
+	}
+	return nil
+}
+
+// makeProxyFilters converts and validates the filter chains of a proxy. Chains the proxy doesn't set
+// default to the ones annotated on its namespace.
+func makeProxyFilters(proxy *v1alpha1.Proxy, ns *corev1.Namespace) (store.ProxyFilters, error) {
+	senderFilters, receiverFilters, err := namespaceFilters(ns)
+	if err != nil {
+		return store.ProxyFilters{}, fmt.Errorf("namespace %s: %w", ns.Name, err)
+	}
+	if proxy.Spec.Filters != nil {
+		senderFilters = proxy.Spec.Filters
+	}
+	if proxy.Spec.ReceiverFilters != nil {
+		receiverFilters = proxy.Spec.ReceiverFilters
+	}
+	sender, err := makeFilters(senderFilters)
+	if err != nil {
+		return store.ProxyFilters{}, fmt.Errorf("filters: %w", err)
+	}
+	receiver, err := makeFilters(receiverFilters)
+	if err != nil {
+		return store.ProxyFilters{}, fmt.Errorf("receiverFilters: %w", err)
+	}
+	filters := store.ProxyFilters{Sender: sender, Receiver: receiver}
+	if proxy.Spec.Firewall != nil {
+		if err := (&quilkin.Firewall{Sources: proxy.Spec.Firewall.AllowedCIDRs}).Validate(); err != nil {
+			return store.ProxyFilters{}, fmt.Errorf("firewall: %w", err)
+		}
+		filters.Firewall = &store.Firewall{CIDRs: proxy.Spec.Firewall.AllowedCIDRs}
+	}
+	return filters, nil
+}
+
+// makeFilters converts a filter chain from the API into quilkin filters
+func makeFilters(filters []v1alpha1.Filter) ([]quilkin.Filter, error) {
+	chain := make([]quilkin.Filter, 0, len(filters))
+	for i, filter := range filters {
+		var set []quilkin.Filter
+		if filter.Compress != nil {
+			f := quilkin.Compress(*filter.Compress)
+			set = append(set, &f)
+		}
+		if filter.CaptureBytes != nil {
+			f := quilkin.CaptureBytes(*filter.CaptureBytes)
+			set = append(set, &f)
+		}
+		if filter.LocalRateLimit != nil {
+			f := quilkin.LocalRateLimit(*filter.LocalRateLimit)
+			set = append(set, &f)
+		}
+		if len(set) != 1 {
+			return nil, fmt.Errorf("filter %d must set exactly one filter type", i)
+		}
+		chain = append(chain, set[0])
+	}
+	if err := quilkin.ValidateFilters(chain); err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+// gatewayName returns the name of the objects making up the gateway of a proxy
+func gatewayName(proxy *v1alpha1.Proxy) string {
+	return "quilkin-gateway-" + proxy.Name
+}
+
+// gatewayLabels returns the labels set on the objects making up the gateway of a proxy
+func gatewayLabels(proxy *v1alpha1.Proxy) map[string]string {
+	return map[string]string{
+		ManagedByLabel: ManagedByValue,
+		ProxyLabel:     proxy.Name,
+		ComponentLabel: gatewayComponent,
+	}
+}
+
+// serviceAddresses returns the addresses a service can be reached on
+func serviceAddresses(svc *corev1.Service) []string {
+	addresses := make([]string, 0)
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			addresses = append(addresses, ingress.IP)
+		} else if ingress.Hostname != "" {
+			addresses = append(addresses, ingress.Hostname)
+		}
+	}
+	if svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != corev1.ClusterIPNone {
+		addresses = append(addresses, svc.Spec.ClusterIP)
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+	return addresses
+}
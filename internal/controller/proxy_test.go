@@ -0,0 +1,118 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nfowl/quilkin-controller/api/v1alpha1"
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// lastUpdate drains the updates sent by the store and returns the last one
+func lastUpdate(t *testing.T, updates chan store.NodeConfig) store.NodeConfig {
+	var last store.NodeConfig
+	for {
+		select {
+		case update := <-updates:
+			last = update
+		default:
+			if last.ProxyName == "" {
+				t.Fatal("expected a store update")
+			}
+			return last
+		}
+	}
+}
+
+func TestProxyReconcilerRejectsDuplicateNames(t *testing.T) {
+	ctx := context.Background()
+	older := &v1alpha1.Proxy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "games", Name: "server", CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour))},
+		Spec:       v1alpha1.ProxySpec{Filters: []v1alpha1.Filter{{Compress: &v1alpha1.CompressFilter{OnRead: "Compress", OnWrite: "Decompress"}}}},
+	}
+	newer := &v1alpha1.Proxy{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "server", CreationTimestamp: metav1.Now()}}
+	c := newFakeClient(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "games"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}},
+		older, newer,
+	)
+	updates := make(chan store.NodeConfig, 10)
+	s := store.NewSotWStore(updates, make(chan string, 10), zap.NewNop().Sugar())
+	s.AddReceiver("server", 7777, "10.0.0.2", "server-0")
+	r := NewProxyReconciler(c, zap.NewNop().Sugar(), s)
+	reconcileProxies := func() {
+		for _, proxy := range []*v1alpha1.Proxy{older, newer} {
+			if _, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(proxy)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	reconcileProxies()
+	if update := lastUpdate(t, updates); len(update.Filters) != 1 {
+		t.Error("the filters of the oldest proxy should be served")
+	}
+	conflicting := &v1alpha1.Proxy{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(newer), conflicting); err != nil {
+		t.Fatal(err)
+	}
+	if conflicting.Status.Conflict != "games/server" {
+		t.Errorf("the newer proxy should report the conflict, got %q", conflicting.Status.Conflict)
+	}
+
+	if err := c.Delete(ctx, older); err != nil {
+		t.Fatal(err)
+	}
+	reconcileProxies()
+	if update := lastUpdate(t, updates); len(update.Filters) != 0 {
+		t.Error("the remaining proxy should take over the name")
+	}
+	taken := &v1alpha1.Proxy{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(newer), taken); err != nil {
+		t.Fatal(err)
+	}
+	if taken.Status.Conflict != "" {
+		t.Errorf("the conflict should be cleared, got %q", taken.Status.Conflict)
+	}
+}
+
+func TestProxyReconcilerRejectsUnsupportedFilters(t *testing.T) {
+	ctx := context.Background()
+	proxy := &v1alpha1.Proxy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "games", Name: "server"},
+		Spec:       v1alpha1.ProxySpec{Firewall: &v1alpha1.FirewallSpec{}},
+	}
+	c := newFakeClient(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "games"}}, proxy)
+	updates := make(chan store.NodeConfig, 10)
+	s := store.NewSotWStore(updates, make(chan string, 10), zap.NewNop().Sugar())
+	r := NewProxyReconciler(c, zap.NewNop().Sugar(), s)
+
+	image := QuilkinImage
+	QuilkinImage = "quilkin:0.2.0"
+	defer func() { QuilkinImage = image }()
+	if _, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(proxy)}); err == nil {
+		t.Error("the firewall filter should be rejected for quilkin 0.2.0")
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+const (
+	// ReadinessGateCondition is the pod condition set once the pod's quilkin sidecar has received endpoints
+	ReadinessGateCondition = "nfowler.dev/quilkin-ready"
+	// ReadySidecarsAnnotation lists the node ids of the sidecars of a gated pod that have received endpoints.
+	// It is shared by the controller replicas as the sidecars of a pod may be connected to different ones.
+	ReadySidecarsAnnotation = "nfowler.dev/quilkin.ready-sidecars"
+	// podIPIndex is the field index of pods by IP
+	podIPIndex = "status.podIP"
+)
+
+var (
+	// ReadinessGate adds a readiness gate to sender pods that is set once their sidecar has received endpoints
+	ReadinessGate = false
+)
+
+// ReadinessGateSetter sets the readiness gate condition of pods once every sidecar injected into them acknowledged
+// a config with endpoints. It runs on every replica as proxies may be connected to any of them.
+type ReadinessGateSetter struct {
+	client client.Client
+	logger *zap.SugaredLogger
+	ready  <-chan store.ProxyAck
+}
+
+// NewReadinessGateSetter constructs a new ReadinessGateSetter struct from the passed arguments.
+// Ready proxies are read from the channel provided.
+func NewReadinessGateSetter(c client.Client, l *zap.SugaredLogger, ready <-chan store.ProxyAck) *ReadinessGateSetter {
+	return &ReadinessGateSetter{
+		client: c,
+		logger: l,
+		ready:  ready,
+	}
+}
+
+// SetupWithManager indexes pods by IP and adds the setter to the manager
+func (r *ReadinessGateSetter) SetupWithManager(mgr manager.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, podIPIndex, func(o client.Object) []string {
+		pod := o.(*corev1.Pod)
+		if pod.Status.PodIP == "" {
+			return nil
+		}
+		return []string{pod.Status.PodIP}
+	})
+	if err != nil {
+		return err
+	}
+	return mgr.Add(r)
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable
+func (r *ReadinessGateSetter) NeedLeaderElection() bool {
+	return false
+}
+
+// Start sets the condition of pods as their sidecars become ready. It implements manager.Runnable.
+func (r *ReadinessGateSetter) Start(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ack := <-r.ready:
+			if err := r.setReady(ctx, ack); err != nil {
+				r.logger.Errorw("Failed to set readiness gate", "ip", ack.IP, "node", ack.NodeID, "error", err)
+			}
+		}
+	}
+}
+
+// setReady records the sidecar provided as ready on the gated pods with its IP, setting their readiness gate
+// condition once all of their sidecars are. Pods injected before their sidecar node ids were recorded are
+// ready once any of their sidecars is.
+func (r *ReadinessGateSetter) setReady(ctx context.Context, ack store.ProxyAck) error {
+	pods := &corev1.PodList{}
+	if err := r.client.List(ctx, pods, client.MatchingFields{podIPIndex: ack.IP}); err != nil {
+		return err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !hasReadinessGate(pod) || podConditionTrue(pod, ReadinessGateCondition) || pod.Spec.HostNetwork {
+			continue
+		}
+		expected := sidecarNodeIDs(pod)
+		if len(expected) > 0 {
+			if !containsString(expected, ack.NodeID) {
+				continue
+			}
+			var err error
+			if pod, err = r.recordReadySidecar(ctx, pod, ack.NodeID); err != nil {
+				return err
+			}
+			if ready := readySidecars(pod); !containsAll(ready, expected) {
+				r.logger.Infow("Waiting for the remaining sidecars", "pod", pod.Name, "namespace", pod.Namespace, "ready", len(ready), "sidecars", len(expected))
+				continue
+			}
+		}
+		// Strategic merge only sends this condition, leaving the kubelet's conditions alone
+		patch := client.StrategicMergeFrom(pod.DeepCopy())
+		setPodCondition(pod, corev1.PodCondition{
+			Type:               ReadinessGateCondition,
+			Status:             corev1.ConditionTrue,
+			Reason:             "ConfigReceived",
+			Message:            "Quilkin sidecars received endpoints from the management server",
+			LastTransitionTime: metav1.Now(),
+		})
+		r.logger.Infow("Setting readiness gate", "pod", pod.Name, "namespace", pod.Namespace)
+		if err := r.client.Status().Patch(ctx, pod, patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordReadySidecar adds the node id provided to the ReadySidecarsAnnotation of the pod and returns the updated pod
+func (r *ReadinessGateSetter) recordReadySidecar(ctx context.Context, pod *corev1.Pod, nodeID string) (*corev1.Pod, error) {
+	key := client.ObjectKeyFromObject(pod)
+	latest := pod.DeepCopy()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if latest == nil {
+			latest = &corev1.Pod{}
+			if err := r.client.Get(ctx, key, latest); err != nil {
+				return err
+			}
+		}
+		ready := readySidecars(latest)
+		if containsString(ready, nodeID) {
+			return nil
+		}
+		// The optimistic lock makes concurrent replicas retry rather than drop each other's node ids
+		patch := client.MergeFromWithOptions(latest.DeepCopy(), client.MergeFromWithOptimisticLock{})
+		metav1.SetMetaDataAnnotation(&latest.ObjectMeta, ReadySidecarsAnnotation, strings.Join(append(ready, nodeID), ","))
+		err := r.client.Patch(ctx, latest, patch)
+		if err != nil {
+			latest = nil
+		}
+		return err
+	})
+	return latest, err
+}
+
+// readySidecars returns the node ids in the ReadySidecarsAnnotation of the pod
+func readySidecars(pod *corev1.Pod) []string {
+	value := pod.Annotations[ReadySidecarsAnnotation]
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// containsAll returns whether every value of expected is in values
+func containsAll(values []string, expected []string) bool {
+	for _, value := range expected {
+		if !containsString(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// addReadinessGate adds the quilkin readiness gate to a pod
+func addReadinessGate(pod *corev1.Pod) {
+	if !hasReadinessGate(pod) {
+		pod.Spec.ReadinessGates = append(pod.Spec.ReadinessGates, corev1.PodReadinessGate{ConditionType: ReadinessGateCondition})
+	}
+}
+
+// hasReadinessGate returns whether the pod has the quilkin readiness gate
+func hasReadinessGate(pod *corev1.Pod) bool {
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == ReadinessGateCondition {
+			return true
+		}
+	}
+	return false
+}
+
+// podConditionTrue returns whether the condition provided is true on the pod
+func podConditionTrue(pod *corev1.Pod, conditionType corev1.PodConditionType) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == conditionType {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// setPodCondition adds or replaces a condition of the pod
+func setPodCondition(pod *corev1.Pod, condition corev1.PodCondition) {
+	for i := range pod.Status.Conditions {
+		if pod.Status.Conditions[i].Type == condition.Type {
+			pod.Status.Conditions[i] = condition
+			return
+		}
+	}
+	pod.Status.Conditions = append(pod.Status.Conditions, condition)
+}
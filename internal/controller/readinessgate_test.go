@@ -0,0 +1,73 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestReadinessGateWaitsForEverySidecar(t *testing.T) {
+	ReadinessGate = true
+	defer func() { ReadinessGate = false }()
+	ctx := context.Background()
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "games"}}
+	c := patchOnlyClient{newFakeClient(ns)}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: "games", Annotations: map[string]string{SenderAnnotation: "server,chat"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "game", Image: "game"}}},
+	}
+	if err := NewQuilkinAnnotationReader(c, zap.NewNop().Sugar(), nil).injectPod(ctx, ns, pod); err != nil {
+		t.Fatal(err)
+	}
+	pod.Status.PodIP = "10.0.0.5"
+	if err := c.Create(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReadinessGateSetter(c, zap.NewNop().Sugar(), nil)
+	for _, ack := range []store.ProxyAck{{IP: "10.0.0.5", NodeID: "server"}, {IP: "10.0.0.5", NodeID: "unknown"}} {
+		if err := r.setReady(ctx, ack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(pod), pod); err != nil {
+		t.Fatal(err)
+	}
+	if podConditionTrue(pod, ReadinessGateCondition) {
+		t.Error("the pod should wait for the sidecar of every proxy")
+	}
+	if ready := readySidecars(pod); len(ready) != 1 || ready[0] != "server" {
+		t.Errorf("expected the server sidecar to be recorded, got %v", ready)
+	}
+
+	if err := r.setReady(ctx, store.ProxyAck{IP: "10.0.0.5", NodeID: "chat"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(pod), pod); err != nil {
+		t.Fatal(err)
+	}
+	if !podConditionTrue(pod, ReadinessGateCondition) {
+		t.Error("the pod should be ready once every sidecar is")
+	}
+}
@@ -20,7 +20,9 @@ import (
 	"context"
 	"errors"
 	"strings"
+	"time"
 
+	"github.com/nfowl/quilkin-controller/internal/quilkin"
 	"github.com/nfowl/quilkin-controller/internal/store"
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
@@ -61,34 +63,35 @@ func (q *QuilkinReconciler) Reconcile(ctx context.Context, req reconcile.Request
 		q.logger.Infow("Handling finalizer")
 		value, ok := pod.Annotations[ReceiverAnnotation]
 		if ok {
+			// Terminating receivers keep being served to senders for their drain period
+			if wait := q.drainRemaining(ctx, pod); wait > 0 {
+				q.logger.Infow("Draining receiver", "pod", pod.Name, "remaining", wait.String())
+				return reconcile.Result{RequeueAfter: wait}, nil
+			}
 			proxyName, _, err := parseReceiveAnnotation(value)
 			if err != nil {
 				q.logger.Errorw("Error parsing annotation", "annotation", value)
 			}
 			q.logger.Infow("Removing receiver", "proxy", proxyName, "pod", pod.Name, "ip", pod.Status.PodIP)
-			q.store.RemoveReceiver(proxyName, pod.Name)
+			q.store.RemoveReceiver(proxyName, podKey(pod))
+			q.store.RemoveReceiverProxy(proxyName, podKey(pod))
 		}
 
 		// Handle and remove finalizer for sender
-		value, ok = pod.Annotations[SenderAnnotation]
-		if ok {
-			q.logger.Infow("Removing sender", "sender", value, "pod", pod.Name)
-			_ = q.store.RemoveSender(value, pod.Name)
-			// if lastNode {
-			// 	q.logger.Infow("Removing quilkin sender configmap", "configmap", "quilkin-"+value)
-			// 	cm := &corev1.ConfigMap{}
-			// 	if err = q.client.Get(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: "quilkin-" + value}, cm); err != nil {
-			// 		q.logger.Warnw("Error getting configmap", "namespace", pod.Namespace, "name", "quilkin-"+value, "error", err.Error())
-			// 	}
-			// 	if err := q.client.Delete(ctx, cm); err != nil {
-			// 		q.logger.Warnw("Error deleting configmap", "namespace", pod.Namespace, "name", "quilkin-"+value, "error", err.Error())
-			// 	}
-			// }
+		if _, ok := pod.Annotations[SenderAnnotation]; ok {
+			q.store.RemoveNodeSender(pod.Spec.NodeName, podKey(pod))
+			for _, proxyName := range senderProxies(pod) {
+				q.logger.Infow("Removing sender", "sender", proxyName, "pod", pod.Name)
+				q.store.RemoveSenderVariant(proxyName, podKey(pod))
+				_ = q.store.RemoveSender(proxyName, podKey(pod))
+			}
 		}
 
+		// A merge patch only sends the finalizers, so fields the core/v1 types don't know are kept
+		patch := client.MergeFrom(pod.DeepCopy())
 		controllerutil.RemoveFinalizer(pod, Finalizer)
 		q.logger.Infow("Removing quilkin finalizer", "pod", pod.Name)
-		if err := q.client.Update(ctx, pod); err != nil {
+		if err := q.client.Patch(ctx, pod, patch); err != nil {
 			q.logger.Warnw("failure reconciling. Requeuing pod.", "error", err.Error())
 			return reconcile.Result{
 				Requeue: true,
@@ -104,6 +107,11 @@ func (q *QuilkinReconciler) Reconcile(ctx context.Context, req reconcile.Request
 	return reconcile.Result{}, nil
 }
 
+// podKey returns the key a pod is tracked by in the store. Pods in different namespaces may share a name.
+func podKey(pod *corev1.Pod) string {
+	return client.ObjectKeyFromObject(pod).String()
+}
+
 // handleRunningReceiver This adds the receiver to the xds node
 // This function assumes the pod has already had its annotations checked for the correct one
 func (q *QuilkinReconciler) handleRunningReceiver(pod *corev1.Pod) {
@@ -113,15 +121,69 @@ func (q *QuilkinReconciler) handleRunningReceiver(pod *corev1.Pod) {
 		q.logger.Errorw("Error parsing annotation", "annotation", value)
 	}
 	q.logger.Infow("Adding receiver", "proxy", proxyName, "port", port, "pod", pod.Status.PodIP)
-	q.store.AddReceiver(proxyName, port, pod.Status.PodIP, pod.Name)
+	q.store.AddReceiver(proxyName, port, pod.Status.PodIP, podKey(pod))
+	if target, ok := pod.Annotations[ReceiverProxyAnnotation]; ok {
+		localPort, err := net.ParsePort(target, false)
+		if err != nil {
+			q.logger.Errorw("Error parsing annotation", "annotation", target)
+			return
+		}
+		q.store.AddReceiverProxy(proxyName, localPort, podKey(pod))
+	}
 }
 
 // handleRunningReceiver This adds the sender to the internal store
 // This function assumes the pod has already had its annotations checked for the correct one
 func (q *QuilkinReconciler) handleRunningSender(pod *corev1.Pod) {
 	value := pod.Annotations[SenderAnnotation]
-	q.logger.Infow("Adding sender", "proxy", value)
-	q.store.AddSender(value, pod.Name)
+	proxies, err := parseSenderAnnotation(value)
+	if err != nil {
+		q.logger.Errorw("Error parsing annotation", "annotation", value)
+		return
+	}
+	for _, proxyName := range proxies {
+		q.logger.Infow("Adding sender", "proxy", proxyName)
+		q.store.AddSender(proxyName, podKey(pod), pod.Status.PodIP)
+		if ProxyMode == NodeProxyMode && pod.Spec.NodeName != "" {
+			q.store.AddNodeSender(pod.Spec.NodeName, proxyName, podKey(pod))
+		}
+	}
+	// The config annotation applies to the sidecar of the first proxy
+	if config, ok := pod.Annotations[ConfigAnnotation]; ok && ProxyMode != NodeProxyMode {
+		q.addSenderVariant(proxies[0], config, pod)
+	}
+}
+
+// addSenderVariant serves the filter chain and rate limit of a sender's config annotation to its sidecar
+func (q *QuilkinReconciler) addSenderVariant(proxyName string, value string, pod *corev1.Pod) {
+	config, err := quilkin.ParseSidecarConfig(value)
+	if err != nil {
+		q.logger.Errorw("Error parsing annotation", "annotation", ConfigAnnotation, "pod", pod.Name, "error", err.Error())
+		return
+	}
+	key := config.VariantKey()
+	if key == "" {
+		return
+	}
+	// The chain was validated by the key
+	filters, _ := config.FilterChain()
+	variant := store.VariantFilters{Filters: filters, RateLimit: config.RateLimit}
+	q.store.AddSenderVariant(proxyName, store.SenderVariantID(proxyName, key), variant, podKey(pod))
+}
+
+// drainRemaining returns how much of the drain period of a terminating pod is left
+func (q *QuilkinReconciler) drainRemaining(ctx context.Context, pod *corev1.Pod) time.Duration {
+	ns := &corev1.Namespace{}
+	if err := q.client.Get(ctx, client.ObjectKey{Name: pod.Namespace}, ns); err != nil {
+		q.logger.Warnw("Error getting namespace, ignoring its defaults", "namespace", pod.Namespace, "error", err.Error())
+		ns = nil
+	}
+	settings, err := loadSettings(ctx, q.client, pod, ns)
+	if err != nil {
+		q.logger.Warnw("Invalid injection settings, not draining", "pod", pod.Name, "error", err.Error())
+		return 0
+	}
+	return time.Until(pod.DeletionTimestamp.Add(settings.DrainPeriod))
 }
 
 // parseReceiveAnnotation validates and parses the string provided and returns the proxyName and port
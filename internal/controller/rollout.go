@@ -0,0 +1,257 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// InjectedImageAnnotation records the quilkin image injected into the pod
+	InjectedImageAnnotation = "nfowler.dev/quilkin.injected-image"
+	// ConfigHashAnnotation records a hash of the quilkin containers and configs injected into the pod
+	ConfigHashAnnotation = "nfowler.dev/quilkin.config-hash"
+	// restartedAtAnnotation is the pod template annotation kubectl rollout restart sets
+	restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+)
+
+var (
+	outdatedPods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "quilkin_controller_outdated_pods",
+		Help: "Number of pods whose injected quilkin containers differ from what would be injected now",
+	}, []string{"namespace", "proxy"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(outdatedPods)
+}
+
+// RolloutChecker periodically finds injected pods whose quilkin containers or configs are outdated, e.g. after
+// the quilkin image or a sidecar template changed. Outdated pods are reported per proxy and, when restarts are
+// enabled, the Deployments and StatefulSets owning them are restarted one per period.
+type RolloutChecker struct {
+	client   client.Client
+	logger   *zap.SugaredLogger
+	injector *QuilkinAnnotationReader
+	period   time.Duration
+	restart  bool
+}
+
+// NewRolloutChecker constructs a new RolloutChecker struct from the passed arguments
+func NewRolloutChecker(c client.Client, l *zap.SugaredLogger, period time.Duration, restart bool) *RolloutChecker {
+	return &RolloutChecker{
+		client:   c,
+		logger:   l,
+		injector: NewQuilkinAnnotationReader(c, zap.NewNop().Sugar(), nil),
+		period:   period,
+		restart:  restart,
+	}
+}
+
+// Start checks for outdated pods every period. It implements manager.Runnable.
+func (r *RolloutChecker) Start(ctx context.Context) error {
+	ticker := time.NewTicker(r.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := r.check(ctx); err != nil {
+				r.logger.Errorw("Failed to check for outdated pods", "error", err)
+			}
+		}
+	}
+}
+
+// check reports the outdated pods and restarts the workload owning one of them if enabled
+func (r *RolloutChecker) check(ctx context.Context) error {
+	pods := &corev1.PodList{}
+	if err := r.client.List(ctx, pods); err != nil {
+		return err
+	}
+	namespaces := make(map[string]*corev1.Namespace)
+	counts := make(map[[2]string]int)
+	outdated := make([]*corev1.Pod, 0)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !pod.DeletionTimestamp.IsZero() || !HasAnnotations(pod) || !(hasContainer(pod, senderContainer) || hasContainer(pod, receiverProxyContainer)) {
+			continue
+		}
+		ns, ok := namespaces[pod.Namespace]
+		if !ok {
+			ns = &corev1.Namespace{}
+			if err := r.client.Get(ctx, client.ObjectKey{Name: pod.Namespace}, ns); err != nil {
+				return err
+			}
+			namespaces[pod.Namespace] = ns
+		}
+		isOutdated, err := r.isOutdated(ctx, ns, pod)
+		if err != nil {
+			r.logger.Warnw("Unable to check pod injection", "pod", pod.Name, "namespace", pod.Namespace, "error", err.Error())
+			continue
+		}
+		if isOutdated {
+			outdated = append(outdated, pod)
+			for _, proxyName := range podProxies(pod) {
+				counts[[2]string{pod.Namespace, proxyName}]++
+			}
+		}
+	}
+
+	outdatedPods.Reset()
+	for key, count := range counts {
+		outdatedPods.WithLabelValues(key[0], key[1]).Set(float64(count))
+		r.logger.Infow("Found outdated injected pods", "namespace", key[0], "proxy", key[1], "pods", count)
+	}
+	if !r.restart {
+		return nil
+	}
+	for _, pod := range outdated {
+		workload, err := r.owningWorkload(ctx, pod)
+		if err != nil {
+			return err
+		}
+		if workload == nil || rolloutInProgress(workload) {
+			continue
+		}
+		r.logger.Infow("Restarting workload with outdated injected pods", "namespace", workload.GetNamespace(), "name", workload.GetName(), "pod", pod.Name)
+		return r.restartWorkload(ctx, workload)
+	}
+	return nil
+}
+
+// isOutdated returns whether injecting the pod now would produce different quilkin containers or configs
+func (r *RolloutChecker) isOutdated(ctx context.Context, ns *corev1.Namespace, pod *corev1.Pod) (bool, error) {
+	current := pod.DeepCopy()
+	if err := r.injector.injectPod(ctx, ns, current); err != nil {
+		return false, err
+	}
+	hash, ok := pod.Annotations[ConfigHashAnnotation]
+	return !ok || hash != current.Annotations[ConfigHashAnnotation], nil
+}
+
+// owningWorkload returns the Deployment or StatefulSet controlling the pod, or nil if it has neither
+func (r *RolloutChecker) owningWorkload(ctx context.Context, pod *corev1.Pod) (client.Object, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return nil, nil
+	}
+	switch owner.Kind {
+	case "StatefulSet":
+		sts := &appsv1.StatefulSet{}
+		if err := r.client.Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: owner.Name}, sts); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		return sts, nil
+	case "ReplicaSet":
+		rs := &appsv1.ReplicaSet{}
+		if err := r.client.Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: owner.Name}, rs); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		owner = metav1.GetControllerOf(rs)
+		if owner == nil || owner.Kind != "Deployment" {
+			return nil, nil
+		}
+		deployment := &appsv1.Deployment{}
+		if err := r.client.Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: owner.Name}, deployment); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		return deployment, nil
+	}
+	return nil, nil
+}
+
+// restartWorkload triggers a rolling restart of the workload the same way kubectl rollout restart does
+func (r *RolloutChecker) restartWorkload(ctx context.Context, workload client.Object) error {
+	now := time.Now().Format(time.RFC3339)
+	switch w := workload.(type) {
+	case *appsv1.Deployment:
+		patch := client.MergeFrom(w.DeepCopy())
+		metav1.SetMetaDataAnnotation(&w.Spec.Template.ObjectMeta, restartedAtAnnotation, now)
+		return r.client.Patch(ctx, w, patch)
+	case *appsv1.StatefulSet:
+		patch := client.MergeFrom(w.DeepCopy())
+		metav1.SetMetaDataAnnotation(&w.Spec.Template.ObjectMeta, restartedAtAnnotation, now)
+		return r.client.Patch(ctx, w, patch)
+	}
+	return nil
+}
+
+// rolloutInProgress returns whether the workload is still rolling out a previous change
+func rolloutInProgress(workload client.Object) bool {
+	switch w := workload.(type) {
+	case *appsv1.Deployment:
+		replicas := int32(1)
+		if w.Spec.Replicas != nil {
+			replicas = *w.Spec.Replicas
+		}
+		return w.Generation != w.Status.ObservedGeneration || w.Status.UpdatedReplicas < replicas || w.Status.Replicas > w.Status.UpdatedReplicas
+	case *appsv1.StatefulSet:
+		return w.Generation != w.Status.ObservedGeneration || w.Status.UpdateRevision != w.Status.CurrentRevision
+	}
+	return false
+}
+
+// podProxies returns the proxies the pod sends to or receives from
+func podProxies(pod *corev1.Pod) []string {
+	proxies := make([]string, 0, 2)
+	proxies = append(proxies, senderProxies(pod)...)
+	if proxyName, _, err := parseReceiveAnnotation(pod.Annotations[ReceiverAnnotation]); err == nil {
+		proxies = append(proxies, proxyName)
+	}
+	return proxies
+}
+
+// injectionHash returns a hash of the quilkin containers and the configs of the quilkin config volumes of the pod
+func injectionHash(pod *corev1.Pod, settings InjectionSettings) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	for list, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		// Separates the lists so moving a container between them changes the hash
+		_ = enc.Encode(list)
+		for _, c := range containers {
+			if isInjectedContainer(pod, c.Name) {
+				_ = enc.Encode(c)
+			}
+		}
+	}
+	if version, err := settings.quilkinVersion(); err == nil {
+		_ = enc.Encode(version)
+	}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.ConfigMap == nil {
+			continue
+		}
+		if _, conf, ok := podSidecarConfig(pod, settings, volume.Name, volume.ConfigMap.Name); ok {
+			_ = enc.Encode(conf)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
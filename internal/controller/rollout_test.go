@@ -0,0 +1,79 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestRolloutRestartsOutdatedDeployment(t *testing.T) {
+	ctx := context.Background()
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "games"}}
+	controllerRef := true
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "games", Name: "client"},
+		Status:     appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1},
+	}
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "games", Name: "client-abc", OwnerReferences: []metav1.OwnerReference{
+		{APIVersion: "apps/v1", Kind: "Deployment", Name: "client", UID: "d", Controller: &controllerRef},
+	}}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "games", Name: "client-abc-1", Annotations: map[string]string{SenderAnnotation: "server"}, OwnerReferences: []metav1.OwnerReference{
+			{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "client-abc", UID: "r", Controller: &controllerRef},
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "game", Image: "game"}}},
+	}
+	c := newFakeClient(ns, deployment, rs)
+	r := NewRolloutChecker(c, zap.NewNop().Sugar(), time.Minute, true)
+	if err := r.injector.injectPod(ctx, ns, pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	if pod.Annotations[InjectedImageAnnotation] != QuilkinImage || pod.Annotations[ConfigHashAnnotation] == "" {
+		t.Fatalf("injection should be recorded: %v", pod.Annotations)
+	}
+
+	if outdated, err := r.isOutdated(ctx, ns, pod); err != nil || outdated {
+		t.Fatalf("freshly injected pod should be up to date: %v", err)
+	}
+	if err := r.check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(deployment), deployment); err != nil || deployment.Spec.Template.Annotations[restartedAtAnnotation] != "" {
+		t.Fatal("up to date workloads should not be restarted")
+	}
+
+	image := QuilkinImage
+	QuilkinImage = "quilkin:0.2.0"
+	defer func() { QuilkinImage = image }()
+	if err := r.check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(deployment), deployment); err != nil || deployment.Spec.Template.Annotations[restartedAtAnnotation] == "" {
+		t.Error("outdated workloads should be restarted")
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nfowl/quilkin-controller/internal/quilkin"
+	"github.com/nfowl/quilkin-controller/internal/store"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// senderContainer is the name of the sidecar of a sender's first proxy. Sidecars of further proxies
+	// are suffixed with their index.
+	senderContainer = "quilkin"
+	// InjectedSidecarsAnnotation is the number of sender sidecars injected into a pod. Only containers and
+	// volumes with the index of one of them are treated as injected, others sharing the naming are the pod's own.
+	InjectedSidecarsAnnotation = "nfowler.dev/quilkin.injected-sidecars"
+)
+
+// senderSidecar is a sidecar of a sender pod proxying its traffic to one of its proxies
+type senderSidecar struct {
+	proxy      string
+	container  string
+	volume     string
+	proxyPort  int
+	adminPort  int
+	variantKey string
+}
+
+// parseSenderAnnotation returns the proxies of a sender annotation holding one or more comma separated names
+func parseSenderAnnotation(value string) ([]string, error) {
+	names := strings.Split(value, ",")
+	proxies := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("%s %q has an empty proxy name", SenderAnnotation, value)
+		}
+		if containsString(proxies, name) {
+			return nil, fmt.Errorf("%s %q lists proxy %s twice", SenderAnnotation, value, name)
+		}
+		for _, other := range proxies {
+			if proxyPortEnv(other) == proxyPortEnv(name) {
+				return nil, fmt.Errorf("%s %q lists proxies %s and %s which share the env var %s", SenderAnnotation, value, other, name, proxyPortEnv(name))
+			}
+		}
+		proxies = append(proxies, name)
+	}
+	return proxies, nil
+}
+
+// senderProxies returns the proxies a sender pod sends to, none if its annotation is invalid
+func senderProxies(pod *corev1.Pod) []string {
+	value, ok := pod.Annotations[SenderAnnotation]
+	if !ok {
+		return nil
+	}
+	proxies, err := parseSenderAnnotation(value)
+	if err != nil {
+		return nil
+	}
+	return proxies
+}
+
+// sidecarNames returns the container and config volume names of the sidecar of a sender's proxy at the index provided
+func sidecarNames(index int) (string, string) {
+	if index == 0 {
+		return senderContainer, senderConfigVolume
+	}
+	suffix := "-" + strconv.Itoa(index)
+	return senderContainer + suffix, senderConfigVolume + suffix
+}
+
+// extraSidecarIndex returns the index of a sidecar of a sender's further proxies from the name of its container
+// or volume, which starts with the prefix provided. Only the sidecars counted in the InjectedSidecarsAnnotation
+// of the pod are found.
+func extraSidecarIndex(pod *corev1.Pod, name string, prefix string) (int, bool) {
+	if !strings.HasPrefix(name, prefix+"-") {
+		return 0, false
+	}
+	count, err := strconv.Atoi(pod.Annotations[InjectedSidecarsAnnotation])
+	if err != nil {
+		return 0, false
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(name, prefix+"-"))
+	return index, err == nil && index > 0 && index < count
+}
+
+// isSenderConfigVolume returns whether a volume of the pod with the name provided holds the config of a sender sidecar
+func isSenderConfigVolume(pod *corev1.Pod, name string) bool {
+	if name == senderConfigVolume {
+		return true
+	}
+	_, ok := extraSidecarIndex(pod, name, senderConfigVolume)
+	return ok
+}
+
+// checkSidecarNames returns an error if a container or volume of the pod that wasn't injected has the name
+// of one of the sidecars provided
+func checkSidecarNames(pod *corev1.Pod, sidecars []senderSidecar) error {
+	for _, sidecar := range sidecars {
+		for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+			for _, c := range containers {
+				if c.Name == sidecar.container && !isSidecarContainer(pod, c.Name) {
+					return fmt.Errorf("container %s has the name of the sidecar of proxy %s", c.Name, sidecar.proxy)
+				}
+			}
+		}
+		for _, v := range pod.Spec.Volumes {
+			if v.Name == sidecar.volume && !isSenderConfigVolume(pod, v.Name) {
+				return fmt.Errorf("volume %s has the name of the config volume of proxy %s", v.Name, sidecar.proxy)
+			}
+		}
+	}
+	return nil
+}
+
+// removeExtraSidecars removes the sidecars and config volumes of a sender's proxies from the index provided,
+// e.g. when a proxy was removed from the annotation of a pod template copied from an injected pod.
+// The InjectedSidecarsAnnotation is set to the index so it counts the remaining sidecars.
+func removeExtraSidecars(pod *corev1.Pod, from int) {
+	for _, list := range []*[]corev1.Container{&pod.Spec.InitContainers, &pod.Spec.Containers} {
+		kept := (*list)[:0]
+		for _, c := range *list {
+			if index, ok := extraSidecarIndex(pod, c.Name, senderContainer); !ok || index < from {
+				kept = append(kept, c)
+			}
+		}
+		*list = kept
+	}
+	kept := pod.Spec.Volumes[:0]
+	for _, v := range pod.Spec.Volumes {
+		if index, ok := extraSidecarIndex(pod, v.Name, senderConfigVolume); !ok || index < from {
+			kept = append(kept, v)
+		}
+	}
+	pod.Spec.Volumes = kept
+	metav1.SetMetaDataAnnotation(&pod.ObjectMeta, InjectedSidecarsAnnotation, strconv.Itoa(from))
+}
+
+// proxyPortEnv returns the name of the environment variable holding the local port of a sender's proxy
+func proxyPortEnv(proxyName string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, proxyName)
+	return ProxyPortEnv + "_" + strings.ToUpper(name)
+}
+
+// sidecarNodeIDs returns the xds node ids of the sender sidecars the pod was injected with, none if they weren't recorded
+func sidecarNodeIDs(pod *corev1.Pod) []string {
+	configs := injectedConfigs(pod)
+	ids := make([]string, 0, len(configs))
+	for _, volume := range pod.Spec.Volumes {
+		if volume.ConfigMap == nil || !isSenderConfigVolume(pod, volume.Name) {
+			continue
+		}
+		if config, ok := configs[volume.ConfigMap.Name]; ok {
+			ids = append(ids, config.ID)
+		}
+	}
+	return ids
+}
+
+// nodeID returns the xds node id of the sidecar
+func (s senderSidecar) nodeID() string {
+	if s.variantKey != "" {
+		return store.SenderVariantID(s.proxy, s.variantKey)
+	}
+	return s.proxy
+}
+
+// configName returns the name of the config map of the sidecar. Sidecars using the default ports and the
+// filter chain of their proxy share a config map per proxy.
+func (s senderSidecar) configName() string {
+	name := "quilkin-" + s.proxy
+	if s.variantKey != "" {
+		name += "-" + s.variantKey
+	}
+	if s.proxyPort == quilkinProxyPort && s.adminPort == quilkinAdminPort {
+		return name
+	}
+	return name + "-" + strconv.Itoa(s.proxyPort) + "-" + strconv.Itoa(s.adminPort)
+}
+
+// config returns the quilkin config of the sidecar
+func (s senderSidecar) config() quilkin.QuilkinConfig {
+	conf := quilkin.NewQuilkinConfig(s.nodeID())
+	conf.Proxy.Port = s.proxyPort
+	conf.Admin.Address = "[::]:" + strconv.Itoa(s.adminPort)
+	return conf
+}
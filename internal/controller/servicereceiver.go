@@ -0,0 +1,244 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/nfowl/quilkin-controller/api/v1alpha1"
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// serviceReceiverServiceField is the field index used to look up ServiceReceivers by the Service they target
+const serviceReceiverServiceField = ".spec.service"
+
+// ServiceReceiverReconciler mirrors the EndpointSlices of the Services targeted by ServiceReceivers
+// into the store as receivers of the configured proxy
+type ServiceReceiverReconciler struct {
+	client client.Client
+	logger *zap.SugaredLogger
+	store  *store.SotwStore
+}
+
+// NewServiceReceiverReconciler constructs a new ServiceReceiverReconciler struct from the passed arguments
+func NewServiceReceiverReconciler(c client.Client, l *zap.SugaredLogger, s *store.SotwStore) *ServiceReceiverReconciler {
+	return &ServiceReceiverReconciler{
+		client: c,
+		logger: l,
+		store:  s,
+	}
+}
+
+// SetupWithManager registers the reconciler and the Service/EndpointSlice watches with the manager
+func (s *ServiceReceiverReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1alpha1.ServiceReceiver{}, serviceReceiverServiceField, func(obj client.Object) []string {
+		return []string{obj.(*v1alpha1.ServiceReceiver).Spec.Service}
+	})
+	if err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.ServiceReceiver{}).
+		Watches(&source.Kind{Type: &discoveryv1.EndpointSlice{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return s.receiversForService(obj.GetNamespace(), obj.GetLabels()[discoveryv1.LabelServiceName])
+		})).
+		Watches(&source.Kind{Type: &corev1.Service{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return s.receiversForService(obj.GetNamespace(), obj.GetName())
+		})).
+		Complete(s)
+}
+
+// Reconcile syncs the ready endpoints of the targeted Service into the proxy
+func (s *ServiceReceiverReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	receiver := &v1alpha1.ServiceReceiver{}
+	if err := s.client.Get(ctx, req.NamespacedName, receiver); err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	source := serviceReceiverSource(receiver)
+
+	if !receiver.DeletionTimestamp.IsZero() {
+		if containsString(receiver.GetFinalizers(), Finalizer) {
+			s.logger.Infow("Removing service receiver", "proxy", receiver.Status.Proxy, "receiver", req.NamespacedName.String())
+			s.store.RemoveReceivers(receiver.Status.Proxy, source)
+			controllerutil.RemoveFinalizer(receiver, Finalizer)
+			return reconcile.Result{}, s.client.Update(ctx, receiver)
+		}
+		return reconcile.Result{}, nil
+	}
+
+	if !containsString(receiver.GetFinalizers(), Finalizer) {
+		controllerutil.AddFinalizer(receiver, Finalizer)
+		return reconcile.Result{}, s.client.Update(ctx, receiver)
+	}
+
+	endpoints, err := s.serviceEndpoints(ctx, receiver)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// The proxy was changed so the endpoints need to be removed from the old one
+	if receiver.Status.Proxy != "" && receiver.Status.Proxy != receiver.Spec.Proxy {
+		s.logger.Infow("Moving service receiver", "from", receiver.Status.Proxy, "to", receiver.Spec.Proxy, "receiver", req.NamespacedName.String())
+		s.store.RemoveReceivers(receiver.Status.Proxy, source)
+	}
+	s.logger.Debugw("Setting service receiver endpoints", "proxy", receiver.Spec.Proxy, "receiver", req.NamespacedName.String(), "endpoints", len(endpoints))
+	s.store.SetReceivers(receiver.Spec.Proxy, source, endpoints)
+
+	status := v1alpha1.ServiceReceiverStatus{Proxy: receiver.Spec.Proxy, Endpoints: len(endpoints)}
+	if receiver.Status != status {
+		receiver.Status = status
+		return reconcile.Result{}, s.client.Status().Update(ctx, receiver)
+	}
+	return reconcile.Result{}, nil
+}
+
+// serviceEndpoints returns the endpoints of the service targeted by the receiver.
+// A missing Service or port results in no endpoints rather than an error so the proxy is emptied.
+func (s *ServiceReceiverReconciler) serviceEndpoints(ctx context.Context, receiver *v1alpha1.ServiceReceiver) (map[string]*store.Endpoint, error) {
+	endpoints, found, err := lookupServiceEndpoints(ctx, s.client, receiver.Namespace, receiver.Spec.Service, receiver.Spec.Port)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		s.logger.Infow("Service for receiver has no matching UDP port", "service", receiver.Spec.Service, "namespace", receiver.Namespace, "port", receiver.Spec.Port.String())
+	}
+	return endpoints, nil
+}
+
+// receiversForService returns reconcile requests for every ServiceReceiver targeting the service provided
+func (s *ServiceReceiverReconciler) receiversForService(namespace string, name string) []reconcile.Request {
+	if name == "" {
+		return nil
+	}
+	receivers := &v1alpha1.ServiceReceiverList{}
+	err := s.client.List(context.Background(), receivers, client.InNamespace(namespace), client.MatchingFields{serviceReceiverServiceField: name})
+	if err != nil {
+		s.logger.Errorw("Error listing service receivers", "namespace", namespace, "service", name, "error", err.Error())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(receivers.Items))
+	for _, receiver := range receivers.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: receiver.Namespace, Name: receiver.Name}})
+	}
+	return requests
+}
+
+// lookupServiceEndpoints returns the endpoints of the named UDP port of a service.
+// found is false if the Service or its port doesn't exist.
+func lookupServiceEndpoints(ctx context.Context, c client.Client, namespace string, name string, port intstr.IntOrString) (map[string]*store.Endpoint, bool, error) {
+	svc := &corev1.Service{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, svc)
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	portName, ok := udpServicePortName(svc, port)
+	if !ok {
+		return nil, false, nil
+	}
+	slices := &discoveryv1.EndpointSliceList{}
+	err = c.List(ctx, slices, client.InNamespace(namespace), client.MatchingLabels{discoveryv1.LabelServiceName: svc.Name})
+	if err != nil {
+		return nil, false, err
+	}
+	return endpointsFromSlices(slices.Items, portName), true, nil
+}
+
+// serviceReceiverSource returns the store source key used for endpoints added by a ServiceReceiver
+func serviceReceiverSource(receiver *v1alpha1.ServiceReceiver) string {
+	return "servicereceiver/" + receiver.Namespace + "/" + receiver.Name
+}
+
+// udpServicePortName finds the UDP port on the service matching the name or number provided
+// and returns its name, which is how EndpointSlices reference service ports.
+func udpServicePortName(svc *corev1.Service, port intstr.IntOrString) (string, bool) {
+	for _, p := range svc.Spec.Ports {
+		if p.Protocol != corev1.ProtocolUDP {
+			continue
+		}
+		if (port.Type == intstr.String && p.Name == port.StrVal) || (port.Type == intstr.Int && p.Port == port.IntVal) {
+			return p.Name, true
+		}
+	}
+	return "", false
+}
+
+// endpointsFromSlices converts the endpoints of the slices provided into store endpoints for the named port.
+// Ready endpoints are preferred. If none are ready, endpoints that are still serving while terminating are
+// used instead so traffic keeps flowing during a rollout, matching how kube-proxy treats them.
+func endpointsFromSlices(slices []discoveryv1.EndpointSlice, portName string) map[string]*store.Endpoint {
+	ready := make(map[string]*store.Endpoint)
+	serving := make(map[string]*store.Endpoint)
+	for _, slice := range slices {
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 && slice.AddressType != discoveryv1.AddressTypeIPv6 {
+			continue
+		}
+		port, ok := slicePort(slice.Ports, portName)
+		if !ok {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			isReady := ep.Conditions.Ready == nil || *ep.Conditions.Ready
+			isServing := isReady
+			if ep.Conditions.Serving != nil {
+				isServing = *ep.Conditions.Serving
+			}
+			isTerminating := ep.Conditions.Terminating != nil && *ep.Conditions.Terminating
+			for _, address := range ep.Addresses {
+				key := net.JoinHostPort(address, strconv.Itoa(port))
+				if isReady {
+					ready[key] = &store.Endpoint{Address: address, Port: port}
+				} else if isServing && isTerminating {
+					serving[key] = &store.Endpoint{Address: address, Port: port}
+				}
+			}
+		}
+	}
+	if len(ready) == 0 {
+		return serving
+	}
+	return ready
+}
+
+// slicePort returns the port number of the named UDP port in an EndpointSlice
+func slicePort(ports []discoveryv1.EndpointPort, name string) (int, bool) {
+	for _, p := range ports {
+		if p.Port == nil || (p.Protocol != nil && *p.Protocol != corev1.ProtocolUDP) {
+			continue
+		}
+		if (p.Name == nil && name == "") || (p.Name != nil && *p.Name == name) {
+			return int(*p.Port), true
+		}
+	}
+	return 0, false
+}
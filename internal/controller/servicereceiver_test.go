@@ -0,0 +1,77 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func makeSlice(portName string, port int32, endpoints ...discoveryv1.Endpoint) discoveryv1.EndpointSlice {
+	udp := corev1.ProtocolUDP
+	return discoveryv1.EndpointSlice{
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port, Protocol: &udp}},
+		Endpoints:   endpoints,
+	}
+}
+
+func TestEndpointsFromSlicesReady(t *testing.T) {
+	t.Parallel()
+	slices := []discoveryv1.EndpointSlice{
+		makeSlice("game", 7777,
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: boolPtr(true)}},
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.2"}},
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.3"}, Conditions: discoveryv1.EndpointConditions{Ready: boolPtr(false)}},
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.4"}, Conditions: discoveryv1.EndpointConditions{Ready: boolPtr(false), Serving: boolPtr(true), Terminating: boolPtr(true)}},
+		),
+		makeSlice("other", 8888, discoveryv1.Endpoint{Addresses: []string{"10.0.0.5"}}),
+	}
+	endpoints := endpointsFromSlices(slices, "game")
+	if len(endpoints) != 2 {
+		t.Fatalf("expected 2 ready endpoints got %d", len(endpoints))
+	}
+	if ep, ok := endpoints["10.0.0.1:7777"]; !ok || ep.Port != 7777 || ep.Address != "10.0.0.1" {
+		t.Error("missing ready endpoint")
+	}
+	if _, ok := endpoints["10.0.0.2:7777"]; !ok {
+		t.Error("endpoints without a ready condition should be treated as ready")
+	}
+}
+
+func TestEndpointsFromSlicesServingFallback(t *testing.T) {
+	t.Parallel()
+	slices := []discoveryv1.EndpointSlice{
+		makeSlice("game", 7777,
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.3"}, Conditions: discoveryv1.EndpointConditions{Ready: boolPtr(false)}},
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.4"}, Conditions: discoveryv1.EndpointConditions{Ready: boolPtr(false), Serving: boolPtr(true), Terminating: boolPtr(true)}},
+		),
+	}
+	endpoints := endpointsFromSlices(slices, "game")
+	if len(endpoints) != 1 {
+		t.Fatalf("expected 1 serving endpoint got %d", len(endpoints))
+	}
+	if _, ok := endpoints["10.0.0.4:7777"]; !ok {
+		t.Error("missing terminating serving endpoint")
+	}
+}
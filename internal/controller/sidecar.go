@@ -0,0 +1,184 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// SidecarTemplateAnnotation names a ConfigMap in the pod's namespace holding the sidecar template of the pod
+	SidecarTemplateAnnotation = "nfowler.dev/quilkin.sidecar-template"
+	// NamespaceSidecarTemplate is the name of the ConfigMap holding the sidecar template of every pod in its namespace
+	NamespaceSidecarTemplate = "quilkin-sidecar"
+	// SidecarTemplateKey is the ConfigMap key the template is read from
+	SidecarTemplateKey = "template.yaml"
+)
+
+var (
+	// DefaultSidecarTemplate is the namespace/name of the ConfigMap holding the template applied to every sidecar.
+	// No template is applied when empty.
+	DefaultSidecarTemplate = ""
+)
+
+// SidecarTemplate customises the quilkin containers injected into pods.
+// Templates are layered: the controller default, then the namespace template, then the pod template.
+// Later templates replace the fields they set, env vars, volume mounts and volumes are merged by name.
+type SidecarTemplate struct {
+	Resources       *corev1.ResourceRequirements `json:"resources,omitempty"`
+	SecurityContext *corev1.SecurityContext      `json:"securityContext,omitempty"`
+	Env             []corev1.EnvVar              `json:"env,omitempty"`
+	Args            []string                     `json:"args,omitempty"`
+	ImagePullPolicy corev1.PullPolicy            `json:"imagePullPolicy,omitempty"`
+	// VolumeMounts are added to the quilkin container
+	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+	// Volumes are added to the pod to back the extra volume mounts
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+}
+
+// loadSidecarTemplate builds the template for a pod from the default, namespace and pod templates.
+// Missing default and namespace templates are skipped, a missing pod template is an error.
+func loadSidecarTemplate(ctx context.Context, c client.Reader, pod *corev1.Pod, namespace string) (*SidecarTemplate, error) {
+	template := &SidecarTemplate{}
+	if DefaultSidecarTemplate != "" {
+		parts := strings.SplitN(DefaultSidecarTemplate, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("default sidecar template %q is not namespace/name", DefaultSidecarTemplate)
+		}
+		if err := readSidecarTemplate(ctx, c, template, parts[0], parts[1], true); err != nil {
+			return nil, err
+		}
+	}
+	if err := readSidecarTemplate(ctx, c, template, namespace, NamespaceSidecarTemplate, true); err != nil {
+		return nil, err
+	}
+	if name, ok := pod.Annotations[SidecarTemplateAnnotation]; ok {
+		if err := readSidecarTemplate(ctx, c, template, namespace, name, false); err != nil {
+			return nil, err
+		}
+	}
+	return template, nil
+}
+
+// readSidecarTemplate reads a template ConfigMap and merges it into the template provided
+func readSidecarTemplate(ctx context.Context, c client.Reader, template *SidecarTemplate, namespace string, name string, optional bool) error {
+	cm := &corev1.ConfigMap{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, cm); err != nil {
+		if optional && apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("reading sidecar template %s/%s: %w", namespace, name, err)
+	}
+	layer := &SidecarTemplate{}
+	if err := yaml.UnmarshalStrict([]byte(cm.Data[SidecarTemplateKey]), layer); err != nil {
+		return fmt.Errorf("parsing sidecar template %s/%s: %w", namespace, name, err)
+	}
+	template.merge(layer)
+	return nil
+}
+
+// merge layers the template provided over this one
+func (t *SidecarTemplate) merge(layer *SidecarTemplate) {
+	if layer.Resources != nil {
+		t.Resources = layer.Resources
+	}
+	if layer.SecurityContext != nil {
+		t.SecurityContext = layer.SecurityContext
+	}
+	if layer.Args != nil {
+		t.Args = layer.Args
+	}
+	if layer.ImagePullPolicy != "" {
+		t.ImagePullPolicy = layer.ImagePullPolicy
+	}
+	t.Env = mergeEnv(t.Env, layer.Env)
+	for _, mount := range layer.VolumeMounts {
+		t.VolumeMounts = setVolumeMount(t.VolumeMounts, mount)
+	}
+	for _, volume := range layer.Volumes {
+		t.Volumes = setVolume(t.Volumes, volume)
+	}
+}
+
+// apply applies the template to a quilkin container of the pod provided
+func (t *SidecarTemplate) apply(pod *corev1.Pod, container *corev1.Container) {
+	if t.Resources != nil {
+		container.Resources = *t.Resources.DeepCopy()
+	}
+	if t.SecurityContext != nil {
+		container.SecurityContext = t.SecurityContext.DeepCopy()
+	}
+	if t.Args != nil {
+		container.Args = append([]string(nil), t.Args...)
+	}
+	if t.ImagePullPolicy != "" {
+		container.ImagePullPolicy = t.ImagePullPolicy
+	}
+	container.Env = mergeEnv(container.Env, t.Env)
+	for _, mount := range t.VolumeMounts {
+		container.VolumeMounts = setVolumeMount(container.VolumeMounts, mount)
+	}
+	for _, volume := range t.Volumes {
+		pod.Spec.Volumes = setVolume(pod.Spec.Volumes, *volume.DeepCopy())
+	}
+}
+
+// mergeEnv sets the env vars provided, replacing existing vars with the same name
+func mergeEnv(env []corev1.EnvVar, vars []corev1.EnvVar) []corev1.EnvVar {
+	for _, v := range vars {
+		replaced := false
+		for i := range env {
+			if env[i].Name == v.Name {
+				env[i] = v
+				replaced = true
+			}
+		}
+		if !replaced {
+			env = append(env, v)
+		}
+	}
+	return env
+}
+
+// setVolumeMount adds the mount provided, replacing an existing mount with the same name
+func setVolumeMount(mounts []corev1.VolumeMount, mount corev1.VolumeMount) []corev1.VolumeMount {
+	for i := range mounts {
+		if mounts[i].Name == mount.Name {
+			mounts[i] = mount
+			return mounts
+		}
+	}
+	return append(mounts, mount)
+}
+
+// setVolume adds the volume provided, replacing an existing volume with the same name
+func setVolume(volumes []corev1.Volume, volume corev1.Volume) []corev1.Volume {
+	for i := range volumes {
+		if volumes[i].Name == volume.Name {
+			volumes[i] = volume
+			return volumes
+		}
+	}
+	return append(volumes, volume)
+}
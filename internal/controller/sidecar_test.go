@@ -0,0 +1,88 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func templateConfigMap(namespace, name, template string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Data:       map[string]string{SidecarTemplateKey: template},
+	}
+}
+
+func TestLoadSidecarTemplateLayers(t *testing.T) {
+	c := fake.NewClientBuilder().WithObjects(
+		templateConfigMap("games", NamespaceSidecarTemplate, `
+imagePullPolicy: IfNotPresent
+resources:
+  limits:
+    memory: 64Mi
+env:
+  - name: RUST_LOG
+    value: info
+`),
+		templateConfigMap("games", "debug", `
+args: ["--debug"]
+env:
+  - name: RUST_LOG
+    value: debug
+volumeMounts:
+  - name: extra
+    mountPath: /extra
+volumes:
+  - name: extra
+    emptyDir: {}
+`),
+	).Build()
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{SidecarTemplateAnnotation: "debug"}}}
+	template, err := loadSidecarTemplate(context.Background(), c, pod, "games")
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := makeQuilkinContainer()
+	template.apply(pod, &container)
+
+	if container.ImagePullPolicy != corev1.PullIfNotPresent || container.Resources.Limits.Memory().String() != "64Mi" {
+		t.Error("namespace template should apply")
+	}
+	if len(container.Args) != 1 || len(container.Env) != 1 || container.Env[0].Value != "debug" {
+		t.Errorf("pod template should override the namespace template: %v %v", container.Args, container.Env)
+	}
+	if len(container.VolumeMounts) != 2 || len(pod.Spec.Volumes) != 1 {
+		t.Error("extra volumes should be added")
+	}
+}
+
+func TestLoadSidecarTemplateMissingPodTemplate(t *testing.T) {
+	c := fake.NewClientBuilder().Build()
+	if _, err := loadSidecarTemplate(context.Background(), c, &corev1.Pod{}, "games"); err != nil {
+		t.Errorf("missing namespace template should be skipped: %v", err)
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{SidecarTemplateAnnotation: "missing"}}}
+	if _, err := loadSidecarTemplate(context.Background(), c, pod, "games"); err == nil {
+		t.Error("missing pod template should fail")
+	}
+}
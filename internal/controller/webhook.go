@@ -18,16 +18,19 @@ package controller
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/nfowl/quilkin-controller/internal/quilkin"
 	"github.com/nfowl/quilkin-controller/internal/store"
 	"go.uber.org/zap"
-	"gopkg.in/yaml.v3"
 	admissionv1 "k8s.io/api/admission/v1"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/net"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
@@ -38,13 +41,46 @@ const (
 	ReceiverAnnotation = "nfowler.dev/quilkin.receiver"
 	// Annotation key used to indicate a pod is sending udp traffic to any listening receivers
 	SenderAnnotation = "nfowler.dev/quilkin.sender"
+	// Annotation key used to inject a quilkin proxy in front of a receiver. The value is the local port the
+	// receiver listens on, quilkin takes over the port in the receiver annotation and forwards to it.
+	ReceiverProxyAnnotation = "nfowler.dev/quilkin.receiver-proxy"
+	// Annotation key recording the version of the controller that last injected the pod
+	InjectedVersionAnnotation = "nfowler.dev/quilkin.injected-version"
 	// The finalizer string used to cleanup and setup senders/receivers as part of the reconcile action
 	Finalizer = "quilkin.nfowler.dev/finalizer"
 )
 
+const (
+	// SidecarProxyMode injects a quilkin sidecar into every sender pod
+	SidecarProxyMode = "sidecar"
+	// NodeProxyMode points sender pods at the quilkin proxy running on their node instead of injecting a sidecar
+	NodeProxyMode = "node"
+	// Environment variable holding the address senders should send traffic to in node proxy mode
+	ProxyHostEnv = "QUILKIN_HOST"
+	// Environment variable holding the port senders should send traffic to
+	ProxyPortEnv = "QUILKIN_PORT"
+)
+
+const (
+	// receiverProxyContainer is the name of the quilkin container injected in front of receivers
+	receiverProxyContainer = "quilkin-receiver"
+	// receiverAdminPort is the admin port of the receiver proxy, kept apart from a sender sidecar's
+	receiverAdminPort = 9092
+	// quilkinAdminPort is the admin port of the sender sidecar
+	quilkinAdminPort = 9091
+	// adminProbePath is the quilkin admin endpoint probed for readiness
+	adminProbePath = "/live"
+)
+
 var (
 	// The image source that will be injected in as a sidecar to senders
 	QuilkinImage = "us-docker.pkg.dev/quilkin/release/quilkin:0.1.0"
+	// QuilkinVersion is the quilkin version of QuilkinImage. It is read from the image tag when empty.
+	QuilkinVersion = ""
+	// ProxyMode is how senders reach their proxy, either SidecarProxyMode or NodeProxyMode
+	ProxyMode = SidecarProxyMode
+	// Version is the version of the controller recorded on the pods it injects
+	Version = "dev"
 )
 
 type QuilkinAnnotationReader struct {
@@ -102,58 +138,282 @@ func (q *QuilkinAnnotationReader) handleCreate(ctx context.Context, req admissio
 		return admission.Allowed("No changes required")
 	}
 
-	_, ok := pod.Annotations[ReceiverAnnotation]
+	ns := &v1.Namespace{}
+	if err := q.client.Get(ctx, client.ObjectKey{Name: req.Namespace}, ns); err != nil {
+		return admission.Errored(http.StatusInternalServerError, fmt.Errorf("getting namespace %s: %w", req.Namespace, err))
+	}
+	if err := q.injectPod(ctx, ns, pod); err != nil {
+		q.logger.Errorw("Error injecting pod", "pod", pod.Name, "namespace", req.Namespace, "error", err.Error())
+		return admission.Denied(err.Error())
+	}
+
+	marshaledPod, err := injectedPodJSON(req.Object.Raw, pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
+}
+
+// injectPod adds the finalizer, the quilkin containers and the environment the annotations of the pod ask for.
+// Injection replaces existing quilkin containers and volumes so it is safe to repeat, e.g. when the
+// webhook is reinvoked or a pod template was copied from an injected pod.
+func (q *QuilkinAnnotationReader) injectPod(ctx context.Context, ns *v1.Namespace, pod *v1.Pod) error {
+	settings, err := loadSettings(ctx, q.client, pod, ns)
+	if err != nil {
+		return err
+	}
+	version, err := settings.quilkinVersion()
+	if err != nil {
+		return err
+	}
+	if settings.Config != nil {
+		chain, err := settings.Config.FilterChain()
+		if err != nil {
+			return err
+		}
+		if err := quilkin.CheckFilters(chain, version); err != nil {
+			return fmt.Errorf("%s: %w", ConfigAnnotation, err)
+		}
+	}
+
+	receiver, ok := pod.Annotations[ReceiverAnnotation]
 	if ok {
 		q.logger.Infow("Adding receiver finalizer")
 		controllerutil.AddFinalizer(pod, Finalizer)
+		settings.applyDrainPeriod(pod)
+	}
+	if localPort, ok3 := pod.Annotations[ReceiverProxyAnnotation]; ok && ok3 {
+		if err := q.injectReceiverProxy(ctx, ns, settings, pod, receiver, localPort); err != nil {
+			return err
+		}
 	}
 
-	value, ok2 := pod.Annotations[SenderAnnotation]
-	if ok2 {
-		q.logger.Infow("Adding sender", "pod", pod.Name)
-		cm := &v1.ConfigMap{}
-		err := q.client.Get(ctx, client.ObjectKey{Namespace: req.Namespace, Name: "quilkin-" + value}, cm)
+	senders, ok2 := pod.Annotations[SenderAnnotation]
+	if ok2 && ProxyMode == NodeProxyMode {
+		q.logger.Infow("Pointing sender at node proxy", "pod", pod.Name)
+		proxies, err := parseSenderAnnotation(senders)
 		if err != nil {
-			conf, err := yaml.Marshal(quilkin.NewQuilkinConfig(value))
-			if err != nil {
-				q.logger.Errorw("Error building Quilkin config", "error", err.Error())
+			return err
+		}
+		if err := addNodeProxyEnv(pod, proxies); err != nil {
+			return err
+		}
+		controllerutil.AddFinalizer(pod, Finalizer)
+	} else if ok2 {
+		q.logger.Infow("Adding sender", "pod", pod.Name, "proxies", len(settings.Sidecars))
+		if err := checkSidecarNames(pod, settings.Sidecars); err != nil {
+			return err
+		}
+		removeExtraSidecars(pod, len(settings.Sidecars))
+		for i, sidecar := range settings.Sidecars {
+			container := makeQuilkinContainer()
+			container.Name = sidecar.container
+			container.VolumeMounts[0].Name = sidecar.volume
+			if err := q.prepareSidecar(ctx, ns, settings, sidecar.adminPort, pod, &container); err != nil {
+				return err
 			}
-			//Create new cm
-			cm.Name = "quilkin-" + value
-			cm.Namespace = req.Namespace
-			cm.Labels = make(map[string]string)
-			cm.Labels["managed-by"] = "quilkin-controller"
-			cm.Data = make(map[string]string)
-			cm.Data["quilkin.yaml"] = string(conf)
-			err = q.client.Create(ctx, cm)
-			if err != nil {
-				q.logger.Errorw("Error Creating Configmap", "error", err.Error())
+			// Captured traffic is redirected to the sidecar of the first proxy
+			if i == 0 {
+				if ports, ok := pod.Annotations[CaptureAnnotation]; ok {
+					if err := q.addCapture(ns, settings, pod, &container, ports); err != nil {
+						return err
+					}
+				} else {
+					pod.Spec.InitContainers = removeContainer(pod.Spec.InitContainers, captureContainer)
+				}
 			}
+			setSidecar(pod, container)
+			pod.Spec.Volumes = setVolume(pod.Spec.Volumes, v1.Volume{Name: sidecar.volume, VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: sidecar.configName()}}}})
+		}
+		if ReadinessGate {
+			addReadinessGate(pod)
 		}
-		container := makeQuilkinContainer()
 		q.logger.Infow("Adding sender finalizer", "pod", pod.Name)
 		controllerutil.AddFinalizer(pod, Finalizer)
-		pod.Spec.Containers = append(pod.Spec.Containers, container)
-		pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{Name: "quilkin-config", VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: "quilkin-" + value}}}})
+		addSidecarPortEnv(pod, settings.Sidecars)
 	}
-	marshaledPod, err := json.Marshal(pod)
+	if ok || ok2 {
+		metav1.SetMetaDataAnnotation(&pod.ObjectMeta, InjectedVersionAnnotation, Version)
+		metav1.SetMetaDataAnnotation(&pod.ObjectMeta, InjectedImageAnnotation, settings.Image)
+		metav1.SetMetaDataAnnotation(&pod.ObjectMeta, ConfigHashAnnotation, injectionHash(pod, settings))
+		if err := setInjectedConfigs(pod, settings); err != nil {
+			return err
+		}
+	}
+	addMeshExclusions(pod, ns, injectedPorts(pod, settings), quilkin.ManagementServerPorts())
+
+	return nil
+}
 
+// injectReceiverProxy adds a quilkin container in front of the receiver that applies the receiver
+// filters of its proxy before forwarding packets to the local port provided
+func (q *QuilkinAnnotationReader) injectReceiverProxy(ctx context.Context, ns *v1.Namespace, settings InjectionSettings, pod *v1.Pod, receiver string, localPort string) error {
+	proxyName, port, err := parseReceiveAnnotation(receiver)
 	if err != nil {
-		return admission.Errored(http.StatusInternalServerError, err)
+		return err
 	}
-	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
+	target, err := net.ParsePort(localPort, false)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid port: %w", ReceiverProxyAnnotation, err)
+	}
+	if target == port {
+		return fmt.Errorf("%s must differ from the receiver port as quilkin listens on %d", ReceiverProxyAnnotation, port)
+	}
+	if err := q.checkReceiverFilters(ctx, settings, proxyName); err != nil {
+		return err
+	}
+	q.logger.Infow("Adding receiver proxy", "pod", pod.Name, "proxy", proxyName, "port", port, "target", target)
+	name := receiverProxyConfigName(proxyName, target)
+
+	container := makeQuilkinContainer()
+	container.Name = receiverProxyContainer
+	container.VolumeMounts[0].Name = receiverProxyConfigVolume
+	container.ReadinessProbe = makeAdminProbe(receiverAdminPort)
+	container.Ports = []v1.ContainerPort{
+		{Name: "http-recv-admin", ContainerPort: receiverAdminPort, Protocol: v1.ProtocolTCP},
+		{Name: "udp-receiver", ContainerPort: int32(port), Protocol: v1.ProtocolUDP},
+	}
+	if err := q.prepareSidecar(ctx, ns, settings, 0, pod, &container); err != nil {
+		return err
+	}
+	setSidecar(pod, container)
+	pod.Spec.Volumes = setVolume(pod.Spec.Volumes, v1.Volume{Name: receiverProxyConfigVolume, VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: name}}}})
+	return nil
+}
+
+// checkReceiverFilters returns an error if the receiver filters of the proxy provided aren't available in the
+// quilkin version injected. Proxies that don't exist yet are checked once created.
+func (q *QuilkinAnnotationReader) checkReceiverFilters(ctx context.Context, settings InjectionSettings, proxyName string) error {
+	version, err := settings.quilkinVersion()
+	if err != nil {
+		return err
+	}
+	proxy, err := proxyNameOwner(ctx, q.client, proxyName)
+	if err != nil || proxy == nil {
+		return err
+	}
+	ns := &v1.Namespace{}
+	if err := q.client.Get(ctx, client.ObjectKey{Name: proxy.Namespace}, ns); err != nil {
+		return err
+	}
+	filters, err := makeProxyFilters(proxy, ns)
+	if err != nil {
+		return fmt.Errorf("proxy %s: %w", proxyName, err)
+	}
+	if err := checkFilterVersions(filters, "", version); err != nil {
+		return fmt.Errorf("proxy %s: %w", proxyName, err)
+	}
+	return nil
+}
+
+// injectedPorts returns the ports of the quilkin containers in the pod
+func injectedPorts(pod *v1.Pod, settings InjectionSettings) []int {
+	ports := make([]int, 0, 4)
+	for _, sidecar := range settings.Sidecars {
+		if hasContainer(pod, sidecar.container) {
+			ports = append(ports, sidecar.adminPort, sidecar.proxyPort)
+		}
+	}
+	if hasContainer(pod, receiverProxyContainer) {
+		ports = append(ports, receiverAdminPort)
+		if _, port, err := parseReceiveAnnotation(pod.Annotations[ReceiverAnnotation]); err == nil {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// prepareSidecar applies the injection settings and sidecar template of the pod to a quilkin container and
+// makes it compliant with the pod security level of the namespace. The admin port is left alone when 0.
+func (q *QuilkinAnnotationReader) prepareSidecar(ctx context.Context, ns *v1.Namespace, settings InjectionSettings, adminPort int, pod *v1.Pod, container *v1.Container) error {
+	template, err := loadSidecarTemplate(ctx, q.client, pod, ns.Name)
+	if err != nil {
+		return err
+	}
+	settings.applyContainer(container, adminPort)
+	template.apply(pod, container)
+	// Resources set by annotations take precedence over templates
+	if settings.Resources != nil {
+		container.Resources = *settings.Resources.DeepCopy()
+	}
+	if podSecurityLevel(ns) == PodSecurityRestricted {
+		if err := restrictContainer(pod, container); err != nil {
+			return fmt.Errorf("namespace %s enforces the restricted pod security level: %w", ns.Name, err)
+		}
+	}
+	return nil
+}
+
+// addCapture redirects the pod's outbound traffic to the ports provided into the sidecar. Namespaces
+// enforcing a pod security level reject the capabilities the rules need so the pod is denied there.
+func (q *QuilkinAnnotationReader) addCapture(ns *v1.Namespace, settings InjectionSettings, pod *v1.Pod, container *v1.Container, ports string) error {
+	level := podSecurityLevel(ns)
+	if level == PodSecurityRestricted || level == PodSecurityBaseline {
+		return fmt.Errorf("%s needs the NET_ADMIN capability which the %s pod security level of namespace %s forbids", CaptureAnnotation, level, ns.Name)
+	}
+	q.logger.Infow("Adding traffic capture", "pod", pod.Name, "ports", ports)
+	return addCapture(pod, container, ports, settings.ProxyPort)
+}
+
+// receiverProxyConfigName returns the name of the config map shared by receiver proxies of a proxy and port
+func receiverProxyConfigName(proxyName string, port int) string {
+	return "quilkin-receiver-" + proxyName + "-" + strconv.Itoa(port)
 }
 
 // makeQuilkinContainer constructs the sidecar container definition
 func makeQuilkinContainer() v1.Container {
 	volumes := make([]v1.VolumeMount, 0, 1)
-	volumes = append(volumes, v1.VolumeMount{Name: "quilkin-config", ReadOnly: true, MountPath: "/etc/quilkin"})
+	volumes = append(volumes, v1.VolumeMount{Name: senderConfigVolume, ReadOnly: true, MountPath: "/etc/quilkin"})
 	ports := make([]v1.ContainerPort, 0, 1)
-	ports = append(ports, v1.ContainerPort{Name: "http-admin", ContainerPort: 9091, Protocol: v1.ProtocolTCP})
+	ports = append(ports, v1.ContainerPort{Name: "http-admin", ContainerPort: quilkinAdminPort, Protocol: v1.ProtocolTCP})
 	return v1.Container{
-		Name:         "quilkin",
-		Image:        QuilkinImage,
-		VolumeMounts: volumes,
-		Ports:        ports,
+		Name:           senderContainer,
+		Image:          QuilkinImage,
+		VolumeMounts:   volumes,
+		Ports:          ports,
+		ReadinessProbe: makeAdminProbe(quilkinAdminPort),
+	}
+}
+
+// makeAdminProbe returns a readiness probe against the quilkin admin endpoint on the port provided
+func makeAdminProbe(port int) *v1.Probe {
+	return &v1.Probe{
+		Handler:          v1.Handler{HTTPGet: &v1.HTTPGetAction{Path: adminProbePath, Port: intstr.FromInt(port)}},
+		PeriodSeconds:    5,
+		FailureThreshold: 3,
+	}
+}
+
+// addSidecarPortEnv exposes the ports of the sender sidecars to every container of the pod but the injected ones.
+// The port of the first proxy is also exposed without the proxy name.
+func addSidecarPortEnv(pod *v1.Pod, sidecars []senderSidecar) {
+	env := []v1.EnvVar{{Name: ProxyPortEnv, Value: strconv.Itoa(sidecars[0].proxyPort)}}
+	for _, sidecar := range sidecars {
+		env = append(env, v1.EnvVar{Name: proxyPortEnv(sidecar.proxy), Value: strconv.Itoa(sidecar.proxyPort)})
+	}
+	for i := range pod.Spec.Containers {
+		if !isInjectedContainer(pod, pod.Spec.Containers[i].Name) {
+			pod.Spec.Containers[i].Env = mergeEnv(pod.Spec.Containers[i].Env, env)
+		}
 	}
 }
+
+// addNodeProxyEnv exposes the address of the node local proxies to every container of the pod.
+// The port of the first proxy is also exposed without the proxy name.
+func addNodeProxyEnv(pod *v1.Pod, proxies []string) error {
+	env := []v1.EnvVar{{Name: ProxyHostEnv, ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "status.hostIP"}}}}
+	for i, proxyName := range proxies {
+		port, ok := NodeProxyPorts[proxyName]
+		if !ok {
+			return fmt.Errorf("proxy %s has no node proxy port", proxyName)
+		}
+		if i == 0 {
+			env = append(env, v1.EnvVar{Name: ProxyPortEnv, Value: strconv.Itoa(port)})
+		}
+		env = append(env, v1.EnvVar{Name: proxyPortEnv(proxyName), Value: strconv.Itoa(port)})
+	}
+	for i := range pod.Spec.Containers {
+		pod.Spec.Containers[i].Env = mergeEnv(pod.Spec.Containers[i].Env, env)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nfowl/quilkin-controller/api/v1alpha1"
+	"github.com/nfowl/quilkin-controller/internal/gatewayapi"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newFakeClient returns a fake client that knows the quilkin and Gateway API types
+func newFakeClient(objs ...client.Object) client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(v1alpha1.AddToScheme(scheme))
+	utilruntime.Must(gatewayapi.AddToScheme(scheme))
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+}
+
+func TestInjectPodIdempotent(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "games"}}
+	q := NewQuilkinAnnotationReader(newFakeClient(ns), zap.NewNop().Sugar(), nil)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: "games", Annotations: map[string]string{
+			SenderAnnotation:  "server",
+			CaptureAnnotation: "7777",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "game", Image: "game"}}},
+	}
+
+	if err := q.injectPod(context.Background(), ns, pod); err != nil {
+		t.Fatal(err)
+	}
+	once := pod.DeepCopy()
+	if err := q.injectPod(context.Background(), ns, pod); err != nil {
+		t.Fatal(err)
+	}
+	if !equality.Semantic.DeepEqual(once, pod) {
+		t.Errorf("injecting twice should match injecting once:\n%v\n%v", once.Spec, pod.Spec)
+	}
+	if len(pod.Spec.Containers) != 2 || len(pod.Spec.InitContainers) != 1 || len(pod.Spec.Volumes) != 1 {
+		t.Errorf("expected one sidecar, capture container and volume: %v", pod.Spec)
+	}
+	if pod.Annotations[InjectedVersionAnnotation] != Version {
+		t.Errorf("expected injected version %q, got %q", Version, pod.Annotations[InjectedVersionAnnotation])
+	}
+
+	delete(pod.Annotations, CaptureAnnotation)
+	if err := q.injectPod(context.Background(), ns, pod); err != nil {
+		t.Fatal(err)
+	}
+	if len(pod.Spec.InitContainers) != 0 {
+		t.Error("capture container should be removed once the annotation is")
+	}
+}
+
+func TestInjectPodProxyPorts(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "games"}}
+	proxy := &v1alpha1.Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "server", Namespace: "games"},
+		Spec:       v1alpha1.ProxySpec{Sidecar: &v1alpha1.SidecarSpec{Port: 7100}},
+	}
+	q := NewQuilkinAnnotationReader(newFakeClient(ns, proxy), zap.NewNop().Sugar(), nil)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: "games", Annotations: map[string]string{SenderAnnotation: "server"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "game", Image: "game"}}},
+	}
+	if err := q.injectPod(context.Background(), ns, pod); err != nil {
+		t.Fatal(err)
+	}
+	if env := pod.Spec.Containers[0].Env; len(env) != 2 || env[0].Name != ProxyPortEnv || env[0].Value != "7100" {
+		t.Errorf("the sidecar port should be exposed to the pod, got %v", env)
+	}
+	if name := pod.Spec.Volumes[0].ConfigMap.Name; name != "quilkin-server-7100-9091" {
+		t.Errorf("unexpected config map %s", name)
+	}
+}
+
+func TestInjectPodMultipleProxies(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "games"}}
+	q := NewQuilkinAnnotationReader(newFakeClient(ns), zap.NewNop().Sugar(), nil)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: "games", Annotations: map[string]string{SenderAnnotation: "server,telemetry"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "game", Image: "game"}}},
+	}
+	if err := q.injectPod(context.Background(), ns, pod); err != nil {
+		t.Fatal(err)
+	}
+	if len(pod.Spec.Containers) != 3 || len(pod.Spec.Volumes) != 2 {
+		t.Fatalf("expected a sidecar and volume per proxy: %v", pod.Spec)
+	}
+	env := map[string]string{}
+	for _, e := range pod.Spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	if env["QUILKIN_PORT_SERVER"] != "7000" || env["QUILKIN_PORT_TELEMETRY"] != "7001" || env[ProxyPortEnv] != "7000" {
+		t.Errorf("expected the port of each proxy, got %v", env)
+	}
+	if pod.Spec.Volumes[1].ConfigMap.Name != "quilkin-telemetry-7001-9092" {
+		t.Errorf("unexpected config map %s", pod.Spec.Volumes[1].ConfigMap.Name)
+	}
+
+	pod.Annotations[SenderAnnotation] = "server"
+	if err := q.injectPod(context.Background(), ns, pod); err != nil {
+		t.Fatal(err)
+	}
+	if len(pod.Spec.Containers) != 2 || len(pod.Spec.Volumes) != 1 {
+		t.Errorf("removed proxies should lose their sidecar: %v", pod.Spec)
+	}
+}
+
+func TestInjectPodKeepsOwnContainers(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "games"}}
+	q := NewQuilkinAnnotationReader(newFakeClient(ns), zap.NewNop().Sugar(), nil)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: "games", Annotations: map[string]string{SenderAnnotation: "server"}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "game", Image: "game"}, {Name: "quilkin-2", Image: "quilkin"}},
+			Volumes:    []corev1.Volume{{Name: "quilkin-config-2"}},
+		},
+	}
+	if err := q.injectPod(context.Background(), ns, pod); err != nil {
+		t.Fatal(err)
+	}
+	if len(pod.Spec.Containers) != 3 || pod.Spec.Containers[1].Name != "quilkin-2" || len(pod.Spec.Volumes) != 2 {
+		t.Errorf("containers and volumes the pod declared should be kept: %v", pod.Spec)
+	}
+	if env := pod.Spec.Containers[1].Env; len(env) == 0 {
+		t.Error("containers the pod declared should get the proxy env")
+	}
+
+	pod.Annotations[SenderAnnotation] = "server,telemetry,chat"
+	if err := q.injectPod(context.Background(), ns, pod); err == nil {
+		t.Error("sidecars should not replace containers the pod declared")
+	}
+}
+
+func TestInjectPodRejectsSharedPortEnv(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "games"}}
+	q := NewQuilkinAnnotationReader(newFakeClient(ns), zap.NewNop().Sugar(), nil)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: "games", Annotations: map[string]string{SenderAnnotation: "my-proxy,my.proxy"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "game", Image: "game"}}},
+	}
+	if err := q.injectPod(context.Background(), ns, pod); err == nil {
+		t.Error("proxies sharing a port env var should be rejected")
+	}
+}
+
+func TestInjectReceiverProxyChecksFilterVersions(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "games"}}
+	proxy := &v1alpha1.Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "server", Namespace: "games"},
+		Spec:       v1alpha1.ProxySpec{Firewall: &v1alpha1.FirewallSpec{}},
+	}
+	c := newFakeClient(ns, proxy)
+	q := NewQuilkinAnnotationReader(c, zap.NewNop().Sugar(), nil)
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "server-0", Namespace: "games", Annotations: map[string]string{
+				ReceiverAnnotation:      "server:7777",
+				ReceiverProxyAnnotation: "7000",
+			}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "game", Image: "game"}}},
+		}
+	}
+
+	if err := q.injectPod(context.Background(), ns, newPod()); err == nil {
+		t.Error("receiver proxies should be denied filters their quilkin version lacks")
+	}
+	proxy.Spec.Firewall = nil
+	if err := c.Update(context.Background(), proxy); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.injectPod(context.Background(), ns, newPod()); err != nil {
+		t.Errorf("receiver proxies should be injected once the filters are supported: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package gatewayapi contains the subset of the Gateway API v1alpha2 types the controller uses.
+// The upstream module requires newer kubernetes libraries than the controller is built with, so the
+// fields read and written are mirrored here and checked against the upstream CRDs in testdata.
+// As fields are missing, objects must only be written with merge patches so that fields unknown to
+// these types are preserved.
+// +kubebuilder:object:generate=true
+package gatewayapi
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// GroupVersion is group version of the mirrored Gateway API types
+	GroupVersion = schema.GroupVersion{Group: "gateway.networking.k8s.io", Version: "v1alpha2"}
+
+	// SchemeBuilder is used to add go types to the GroupVersionKind scheme
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the types in this group-version to the given scheme.
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+const (
+	// ProtocolUDP is the listener protocol for UDP traffic
+	ProtocolUDP = "UDP"
+	// ConditionAccepted is the condition type set on classes, gateways and routes that are accepted
+	ConditionAccepted = "Accepted"
+	// ConditionProgrammed is the condition type set on gateways once the data plane is ready
+	ConditionProgrammed = "Programmed"
+	// ConditionResolvedRefs is the condition type set on routes once their backends are resolved
+	ConditionResolvedRefs = "ResolvedRefs"
+)
+
+// GatewayClassSpec mirrors the upstream GatewayClassSpec
+type GatewayClassSpec struct {
+	ControllerName string `json:"controllerName"`
+}
+
+// GatewayClassStatus mirrors the upstream GatewayClassStatus
+type GatewayClassStatus struct {
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// GatewayClass mirrors the upstream GatewayClass
+type GatewayClass struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GatewayClassSpec   `json:"spec,omitempty"`
+	Status GatewayClassStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// GatewayClassList contains a list of GatewayClass
+type GatewayClassList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GatewayClass `json:"items"`
+}
+
+// Listener mirrors the upstream Listener
+type Listener struct {
+	Name     string `json:"name"`
+	Port     int32  `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+// GatewaySpec mirrors the upstream GatewaySpec
+type GatewaySpec struct {
+	GatewayClassName string     `json:"gatewayClassName"`
+	Listeners        []Listener `json:"listeners"`
+}
+
+// GatewayAddress mirrors the upstream GatewayAddress
+type GatewayAddress struct {
+	Type  *string `json:"type,omitempty"`
+	Value string  `json:"value"`
+}
+
+// GatewayStatus mirrors the upstream GatewayStatus
+type GatewayStatus struct {
+	Addresses  []GatewayAddress   `json:"addresses,omitempty"`
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// Gateway mirrors the upstream Gateway
+type Gateway struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GatewaySpec   `json:"spec,omitempty"`
+	Status GatewayStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// GatewayList contains a list of Gateway
+type GatewayList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Gateway `json:"items"`
+}
+
+// ParentReference mirrors the upstream ParentReference
+type ParentReference struct {
+	Group       *string `json:"group,omitempty"`
+	Kind        *string `json:"kind,omitempty"`
+	Namespace   *string `json:"namespace,omitempty"`
+	Name        string  `json:"name"`
+	SectionName *string `json:"sectionName,omitempty"`
+	Port        *int32  `json:"port,omitempty"`
+}
+
+// BackendRef mirrors the upstream BackendRef
+type BackendRef struct {
+	Group     *string `json:"group,omitempty"`
+	Kind      *string `json:"kind,omitempty"`
+	Name      string  `json:"name"`
+	Namespace *string `json:"namespace,omitempty"`
+	Port      *int32  `json:"port,omitempty"`
+	Weight    *int32  `json:"weight,omitempty"`
+}
+
+// UDPRouteRule mirrors the upstream UDPRouteRule
+type UDPRouteRule struct {
+	BackendRefs []BackendRef `json:"backendRefs,omitempty"`
+}
+
+// UDPRouteSpec mirrors the upstream UDPRouteSpec
+type UDPRouteSpec struct {
+	ParentRefs []ParentReference `json:"parentRefs,omitempty"`
+	Rules      []UDPRouteRule    `json:"rules"`
+}
+
+// RouteParentStatus mirrors the upstream RouteParentStatus
+type RouteParentStatus struct {
+	ParentRef      ParentReference    `json:"parentRef"`
+	ControllerName string             `json:"controllerName"`
+	Conditions     []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// UDPRouteStatus mirrors the upstream UDPRouteStatus
+type UDPRouteStatus struct {
+	Parents []RouteParentStatus `json:"parents"`
+}
+
+//+kubebuilder:object:root=true
+
+// UDPRoute mirrors the upstream UDPRoute
+type UDPRoute struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   UDPRouteSpec   `json:"spec,omitempty"`
+	Status UDPRouteStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// UDPRouteList contains a list of UDPRoute
+type UDPRouteList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []UDPRoute `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GatewayClass{}, &GatewayClassList{}, &Gateway{}, &GatewayList{}, &UDPRoute{}, &UDPRouteList{})
+}
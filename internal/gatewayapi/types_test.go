@@ -0,0 +1,133 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gatewayapi
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// schemaTypes are the Go types with custom JSON encodings and the schema type they are encoded as
+var schemaTypes = map[reflect.Type]string{
+	reflect.TypeOf(metav1.Time{}): "string",
+}
+
+// versionSchema returns the openAPI schema of the mirrored version from an upstream CRD in testdata
+func versionSchema(t *testing.T, file string) map[string]interface{} {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crd := struct {
+		Spec struct {
+			Versions []struct {
+				Name   string `json:"name"`
+				Schema struct {
+					OpenAPIV3Schema map[string]interface{} `json:"openAPIV3Schema"`
+				} `json:"schema"`
+			} `json:"versions"`
+		} `json:"spec"`
+	}{}
+	if err := yaml.Unmarshal(data, &crd); err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range crd.Spec.Versions {
+		if version.Name == GroupVersion.Version {
+			return version.Schema.OpenAPIV3Schema
+		}
+	}
+	t.Fatalf("%s doesn't serve %s", file, GroupVersion.Version)
+	return nil
+}
+
+// checkSchema reports every field of the type provided that is missing from the schema or has another type
+func checkSchema(t *testing.T, path string, typ reflect.Type, schema map[string]interface{}) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	schemaType, _ := schema["type"].(string)
+	if want, ok := schemaTypes[typ]; ok {
+		if schemaType != want {
+			t.Errorf("%s is a %s upstream, not a %s", path, schemaType, want)
+		}
+		return
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		if schemaType != "object" {
+			t.Errorf("%s is a %s upstream, not an object", path, schemaType)
+			return
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		if properties == nil {
+			// Objects like metadata aren't described by CRD schemas
+			return
+		}
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if field.Anonymous && name == "" {
+				checkSchema(t, path, field.Type, schema)
+				continue
+			}
+			property, ok := properties[name].(map[string]interface{})
+			if !ok {
+				t.Errorf("%s.%s doesn't exist upstream", path, name)
+				continue
+			}
+			checkSchema(t, path+"."+name, field.Type, property)
+		}
+	case reflect.Slice:
+		if schemaType != "array" {
+			t.Errorf("%s is a %s upstream, not an array", path, schemaType)
+			return
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		checkSchema(t, path+"[]", typ.Elem(), items)
+	case reflect.String:
+		if schemaType != "string" {
+			t.Errorf("%s is a %s upstream, not a string", path, schemaType)
+		}
+	case reflect.Int32, reflect.Int64:
+		if schemaType != "integer" {
+			t.Errorf("%s is a %s upstream, not an integer", path, schemaType)
+		}
+	case reflect.Bool:
+		if schemaType != "boolean" {
+			t.Errorf("%s is a %s upstream, not a boolean", path, schemaType)
+		}
+	default:
+		t.Errorf("%s has unsupported kind %s", path, typ.Kind())
+	}
+}
+
+func TestTypesMatchUpstream(t *testing.T) {
+	for file, obj := range map[string]interface{}{
+		"gateway.networking.k8s.io_gatewayclasses.yaml": GatewayClass{},
+		"gateway.networking.k8s.io_gateways.yaml":       Gateway{},
+		"gateway.networking.k8s.io_udproutes.yaml":      UDPRoute{},
+	} {
+		typ := reflect.TypeOf(obj)
+		checkSchema(t, typ.Name(), typ, versionSchema(t, file))
+	}
+}
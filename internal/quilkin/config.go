@@ -16,8 +16,6 @@ limitations under the License.
 
 package quilkin
 
-import "os"
-
 type ProxyConfig struct {
 	Id   string `yaml:"id"`
 	Port int    `yaml:"port"`
@@ -42,11 +40,19 @@ type QuilkinConfig struct {
 	Dynamic DynamicConfig `yaml:"dynamic"`
 }
 
+// NewQuilkinConfig returns the config of a proxy. Its version is set when it is rendered for a quilkin version.
 func NewQuilkinConfig(proxyName string) QuilkinConfig {
 	return QuilkinConfig{
-		Version: "v1alpha1",
 		Proxy:   ProxyConfig{Id: proxyName, Port: 7000},
 		Admin:   AdminConfig{Address: "[::]:9091"},
-		Dynamic: DynamicConfig{ManagementServers: []*Address{{Address: "http://" + os.Getenv("SVC_NAME") + "." + os.Getenv("POD_NAMESPACE") + ".svc.cluster.local:18000"}}},
+		Dynamic: DynamicConfig{ManagementServers: managementServerAddresses()},
+	}
+}
+
+func managementServerAddresses() []*Address {
+	addresses := make([]*Address, 0, len(managementServers))
+	for _, server := range managementServers {
+		addresses = append(addresses, &Address{Address: server})
 	}
+	return addresses
 }
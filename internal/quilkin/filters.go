@@ -0,0 +1,314 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quilkin
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Filter is a filter in a quilkin filter chain
+type Filter interface {
+	// Name returns the name quilkin registers the filter under
+	Name() string
+	// Validate returns an error if the filter config is invalid
+	Validate() error
+	// MarshalProto encodes the config as the protobuf message quilkin decodes from xds
+	MarshalProto() []byte
+}
+
+// FilterConfig is a filter as written in a static quilkin config file
+type FilterConfig struct {
+	Name   string `yaml:"name"`
+	Config Filter `yaml:"config,omitempty"`
+}
+
+// NewFilterConfigs converts a filter chain into the form used in static config files
+func NewFilterConfigs(filters []Filter) []FilterConfig {
+	configs := make([]FilterConfig, 0, len(filters))
+	for _, filter := range filters {
+		configs = append(configs, FilterConfig{Name: filter.Name(), Config: filter})
+	}
+	return configs
+}
+
+// ValidateFilters validates every filter in the chain
+func ValidateFilters(filters []Filter) error {
+	for i, filter := range filters {
+		if err := filter.Validate(); err != nil {
+			return fmt.Errorf("filter %d (%s): %w", i, filter.Name(), err)
+		}
+	}
+	return nil
+}
+
+const (
+	// CompressFilterName is the name of the Compress filter
+	CompressFilterName = "quilkin.extensions.filters.compress.v1alpha1.Compress"
+	// CaptureBytesFilterName is the name of the CaptureBytes filter
+	CaptureBytesFilterName = "quilkin.extensions.filters.capture_bytes.v1alpha1.CaptureBytes"
+	// LocalRateLimitFilterName is the name of the LocalRateLimit filter
+	LocalRateLimitFilterName = "quilkin.extensions.filters.local_rate_limit.v1alpha1.LocalRateLimit"
+	// FirewallFilterName is the name of the Firewall filter
+	FirewallFilterName = "quilkin.extensions.filters.firewall.v1alpha1.Firewall"
+
+	// minRateLimitPeriod is the shortest rate limit period quilkin accepts
+	minRateLimitPeriod = 100 * time.Millisecond
+)
+
+var (
+	compressModes   = []string{"Snappy"}
+	compressActions = []string{"DoNothing", "Compress", "Decompress"}
+	captureStrategy = []string{"Prefix", "Suffix"}
+)
+
+// Compress compresses or decompresses packets as they are read from senders or written to receivers
+type Compress struct {
+	// Mode is the compression algorithm. Only Snappy is supported.
+	Mode string `json:"mode,omitempty" yaml:"-"`
+	// OnRead is the action applied to packets read from senders. One of Compress, Decompress or DoNothing.
+	OnRead string `json:"onRead,omitempty" yaml:"-"`
+	// OnWrite is the action applied to packets written back to senders. One of Compress, Decompress or DoNothing.
+	OnWrite string `json:"onWrite,omitempty" yaml:"-"`
+}
+
+// Name implements Filter
+func (c *Compress) Name() string {
+	return CompressFilterName
+}
+
+// Validate implements Filter
+func (c *Compress) Validate() error {
+	if _, ok := enumIndex(compressModes, c.Mode); !ok {
+		return fmt.Errorf("invalid mode %q", c.Mode)
+	}
+	if _, ok := enumIndex(compressActions, c.OnRead); !ok {
+		return fmt.Errorf("invalid onRead action %q", c.OnRead)
+	}
+	if _, ok := enumIndex(compressActions, c.OnWrite); !ok {
+		return fmt.Errorf("invalid onWrite action %q", c.OnWrite)
+	}
+	return nil
+}
+
+// MarshalProto implements Filter
+func (c *Compress) MarshalProto() []byte {
+	mode, _ := enumIndex(compressModes, c.Mode)
+	onRead, _ := enumIndex(compressActions, c.OnRead)
+	onWrite, _ := enumIndex(compressActions, c.OnWrite)
+	b := appendEnumValue(nil, 1, mode)
+	b = appendEnumValue(b, 2, onRead)
+	return appendEnumValue(b, 3, onWrite)
+}
+
+// MarshalYAML writes the filter in the form quilkin expects in static config files
+func (c *Compress) MarshalYAML() (interface{}, error) {
+	return map[string]string{
+		"mode":     enumYAML(compressModes, c.Mode),
+		"on_read":  enumYAML(compressActions, c.OnRead),
+		"on_write": enumYAML(compressActions, c.OnWrite),
+	}, nil
+}
+
+// CaptureBytes captures bytes from the start or end of packets into metadata, optionally removing them.
+// Paired with Remove it strips tokens added by clients before packets reach game servers.
+type CaptureBytes struct {
+	// Strategy is where the bytes are captured from. One of Prefix or Suffix.
+	Strategy string `json:"strategy,omitempty" yaml:"-"`
+	// Size is the number of bytes to capture
+	Size uint32 `json:"size" yaml:"-"`
+	// MetadataKey is the key the captured bytes are stored under
+	MetadataKey string `json:"metadataKey,omitempty" yaml:"-"`
+	// Remove removes the captured bytes from the packet
+	Remove bool `json:"remove,omitempty" yaml:"-"`
+}
+
+// Name implements Filter
+func (c *CaptureBytes) Name() string {
+	return CaptureBytesFilterName
+}
+
+// Validate implements Filter
+func (c *CaptureBytes) Validate() error {
+	if _, ok := enumIndex(captureStrategy, c.Strategy); !ok {
+		return fmt.Errorf("invalid strategy %q", c.Strategy)
+	}
+	if c.Size == 0 {
+		return fmt.Errorf("size must be greater than 0")
+	}
+	return nil
+}
+
+// MarshalProto implements Filter
+func (c *CaptureBytes) MarshalProto() []byte {
+	strategy, _ := enumIndex(captureStrategy, c.Strategy)
+	b := appendEnumValue(nil, 1, strategy)
+	b = appendVarint(b, 2, uint64(c.Size))
+	if c.MetadataKey != "" {
+		b = appendMessage(b, 3, appendString(nil, 1, c.MetadataKey))
+	}
+	return appendMessage(b, 4, appendBool(nil, 1, c.Remove))
+}
+
+// MarshalYAML writes the filter in the form quilkin expects in static config files
+func (c *CaptureBytes) MarshalYAML() (interface{}, error) {
+	conf := map[string]interface{}{
+		"strategy": enumYAML(captureStrategy, c.Strategy),
+		"size":     c.Size,
+		"remove":   c.Remove,
+	}
+	if c.MetadataKey != "" {
+		conf["metadataKey"] = c.MetadataKey
+	}
+	return conf, nil
+}
+
+// LocalRateLimit caps the number of packets the proxy forwards per period, dropping the rest. Each sidecar
+// counts its own packets so in a sender's chain it caps the rate of that sender.
+type LocalRateLimit struct {
+	// MaxPackets is the number of packets forwarded per period
+	MaxPackets uint64 `json:"maxPackets" yaml:"-"`
+	// Period is the period packets are counted over, at least 100ms. Defaults to 1s.
+	Period metav1.Duration `json:"period,omitempty" yaml:"-"`
+}
+
+// Name implements Filter
+func (l *LocalRateLimit) Name() string {
+	return LocalRateLimitFilterName
+}
+
+// Validate implements Filter
+func (l *LocalRateLimit) Validate() error {
+	if l.MaxPackets == 0 {
+		return fmt.Errorf("maxPackets must be greater than 0")
+	}
+	if l.Period.Duration != 0 && l.Period.Duration < minRateLimitPeriod {
+		return fmt.Errorf("period must be at least %s, got %s", minRateLimitPeriod, l.Period.Duration)
+	}
+	return nil
+}
+
+// MarshalProto implements Filter
+func (l *LocalRateLimit) MarshalProto() []byte {
+	b := appendVarint(nil, 1, l.MaxPackets)
+	if l.Period.Duration == 0 {
+		return b
+	}
+	// google.protobuf.Duration
+	period := appendVarint(nil, 1, uint64(l.Period.Duration/time.Second))
+	period = appendVarint(period, 2, uint64(l.Period.Duration%time.Second))
+	return appendMessage(b, 2, period)
+}
+
+// MarshalYAML writes the filter in the form quilkin expects in static config files
+func (l *LocalRateLimit) MarshalYAML() (interface{}, error) {
+	conf := map[string]interface{}{
+		"max_packets": l.MaxPackets,
+	}
+	if l.Period.Duration != 0 {
+		conf["period"] = l.Period.Duration.String()
+	}
+	return conf, nil
+}
+
+// Firewall allows packets read from the sources provided and drops the rest. Packets written back are
+// always allowed.
+type Firewall struct {
+	// Sources are the CIDRs packets are read from
+	Sources []string
+}
+
+// firewallAllowAll are the sources matching every address
+var firewallAllowAll = []string{"0.0.0.0/0", "::/0"}
+
+// Name implements Filter
+func (f *Firewall) Name() string {
+	return FirewallFilterName
+}
+
+// Validate implements Filter
+func (f *Firewall) Validate() error {
+	for _, source := range f.Sources {
+		if _, _, err := net.ParseCIDR(source); err != nil {
+			return fmt.Errorf("invalid source %q", source)
+		}
+	}
+	return nil
+}
+
+// MarshalProto implements Filter. Every rule covers all ports, the zero Allow action and minimum port are omitted.
+func (f *Firewall) MarshalProto() []byte {
+	allPorts := appendVarint(nil, 2, 65535)
+	rule := func(source string) []byte {
+		return appendMessage(appendString(nil, 2, source), 3, allPorts)
+	}
+	var b []byte
+	for _, source := range f.Sources {
+		b = appendMessage(b, 1, rule(source))
+	}
+	for _, source := range firewallAllowAll {
+		b = appendMessage(b, 2, rule(source))
+	}
+	return b
+}
+
+// MarshalYAML writes the filter in the form quilkin expects in static config files
+func (f *Firewall) MarshalYAML() (interface{}, error) {
+	rules := func(sources []string) []map[string]interface{} {
+		r := make([]map[string]interface{}, 0, len(sources))
+		for _, source := range sources {
+			r = append(r, map[string]interface{}{"action": "ALLOW", "source": source, "ports": []string{"0-65535"}})
+		}
+		return r
+	}
+	return map[string]interface{}{
+		"on_read":  rules(f.Sources),
+		"on_write": rules(firewallAllowAll),
+	}, nil
+}
+
+// enumIndex returns the proto number of an enum value. Values are matched case insensitively and
+// an empty value is the default first value.
+func enumIndex(values []string, value string) (uint64, bool) {
+	if value == "" {
+		return 0, true
+	}
+	for i, v := range values {
+		if strings.EqualFold(v, value) {
+			return uint64(i), true
+		}
+	}
+	return 0, false
+}
+
+// enumYAML returns the enum value in the upper snake case quilkin uses in config files
+func enumYAML(values []string, value string) string {
+	i, _ := enumIndex(values, value)
+	name := values[i]
+	var b strings.Builder
+	for j, r := range name {
+		if j > 0 && r >= 'A' && r <= 'Z' {
+			b.WriteByte('_')
+		}
+		b.WriteRune(r)
+	}
+	return strings.ToUpper(b.String())
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quilkin
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCompressMarshalProto(t *testing.T) {
+	c := &Compress{Mode: "snappy", OnRead: "Decompress", OnWrite: "Compress"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// Each enum is wrapped in a message: mode=0 (field 1), on_read=2 (field 2), on_write=1 (field 3)
+	want := []byte{0x0a, 0x00, 0x12, 0x02, 0x08, 0x02, 0x1a, 0x02, 0x08, 0x01}
+	if got := c.MarshalProto(); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	if err := (&Compress{OnRead: "Zip"}).Validate(); err == nil {
+		t.Error("invalid action should fail validation")
+	}
+}
+
+func TestCaptureBytesConfig(t *testing.T) {
+	c := &CaptureBytes{Strategy: "Suffix", Size: 3, Remove: true}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x0a, 0x02, 0x08, 0x01, 0x10, 0x03, 0x22, 0x02, 0x08, 0x01}
+	if got := c.MarshalProto(); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	out, err := yaml.Marshal(NewFilterConfigs([]Filter{c}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte("strategy: SUFFIX")) || !bytes.Contains(out, []byte("name: "+CaptureBytesFilterName)) {
+		t.Errorf("unexpected static config:\n%s", out)
+	}
+	if err := (&CaptureBytes{}).Validate(); err == nil {
+		t.Error("zero size should fail validation")
+	}
+}
+
+func TestLocalRateLimitConfig(t *testing.T) {
+	l := &LocalRateLimit{MaxPackets: 100, Period: metav1.Duration{Duration: 1500 * time.Millisecond}}
+	if err := l.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// max_packets=100 (field 1), period=1s 500000000ns (field 2)
+	want := []byte{0x08, 0x64, 0x12, 0x08, 0x08, 0x01, 0x10, 0x80, 0xca, 0xb5, 0xee, 0x01}
+	if got := l.MarshalProto(); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	out, err := yaml.Marshal(NewFilterConfigs([]Filter{l}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte("max_packets: 100")) || !bytes.Contains(out, []byte("period: 1.5s")) {
+		t.Errorf("unexpected static config:\n%s", out)
+	}
+	for _, invalid := range []*LocalRateLimit{{}, {MaxPackets: 1, Period: metav1.Duration{Duration: time.Millisecond}}} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("%+v should fail validation", invalid)
+		}
+	}
+}
+
+func TestFirewallConfig(t *testing.T) {
+	f := &Firewall{Sources: []string{"10.0.0.1/32"}}
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// on_read (field 1) allows the source, on_write (field 2) allows every address, both on ports 0-65535
+	want := []byte{0x0a, 0x13, 0x12, 0x0b}
+	want = append(want, "10.0.0.1/32"...)
+	want = append(want, 0x1a, 0x04, 0x10, 0xff, 0xff, 0x03)
+	if got := f.MarshalProto(); !bytes.HasPrefix(got, want) || bytes.Count(got, []byte{0x1a, 0x04, 0x10, 0xff, 0xff, 0x03}) != 3 {
+		t.Errorf("got %x, want prefix %x", got, want)
+	}
+	out, err := yaml.Marshal(NewFilterConfigs([]Filter{f}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte("source: 10.0.0.1/32")) || !bytes.Contains(out, []byte("action: ALLOW")) {
+		t.Errorf("unexpected static config:\n%s", out)
+	}
+	if err := (&Firewall{Sources: []string{"10.0.0.1"}}).Validate(); err == nil {
+		t.Error("sources should be CIDRs")
+	}
+}
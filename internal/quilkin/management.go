@@ -0,0 +1,132 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quilkin
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/utils/net"
+)
+
+// managementServers are the management server URLs written into generated configs
+var managementServers []string
+
+// ManagementServerOptions describes how proxies reach the xds server
+type ManagementServerOptions struct {
+	// Service is the name of the Service in front of the xds server
+	Service string
+	// Namespace is the namespace of the Service
+	Namespace string
+	// ClusterDomain is the DNS domain of the cluster
+	ClusterDomain string
+	// Port is the port of the Service
+	Port int
+	// Scheme is the scheme proxies connect to the Service with. Either http or https.
+	Scheme string
+	// TLS is whether the xds server serves TLS. Proxies must then connect with https.
+	TLS bool
+	// Addresses are management server URLs used instead of the Service, e.g. one per replica or
+	// a server outside the cluster
+	Addresses []string
+}
+
+// URLs validates the options and returns the management server URLs proxies connect to
+func (o ManagementServerOptions) URLs() ([]string, error) {
+	if len(o.Addresses) > 0 {
+		urls := make([]string, 0, len(o.Addresses))
+		for _, address := range o.Addresses {
+			if err := o.validateURL(address); err != nil {
+				return nil, err
+			}
+			urls = append(urls, address)
+		}
+		return urls, nil
+	}
+	if err := o.validateScheme(o.Scheme); err != nil {
+		return nil, err
+	}
+	if o.Port < 1 || o.Port > 65535 {
+		return nil, fmt.Errorf("invalid management server port %d", o.Port)
+	}
+	if errs := validation.IsDNS1035Label(o.Service); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid management server service %q: %s", o.Service, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1123Label(o.Namespace); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid management server namespace %q: %s", o.Namespace, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1123Subdomain(o.ClusterDomain); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid cluster domain %q: %s", o.ClusterDomain, strings.Join(errs, ", "))
+	}
+	host := o.Service + "." + o.Namespace + ".svc." + o.ClusterDomain
+	return []string{o.Scheme + "://" + host + ":" + strconv.Itoa(o.Port)}, nil
+}
+
+// validateScheme returns an error unless the scheme is http or https and matches whether the xds server serves TLS
+func (o ManagementServerOptions) validateScheme(scheme string) error {
+	switch {
+	case scheme != "http" && scheme != "https":
+		return fmt.Errorf("invalid management server scheme %q, must be http or https", scheme)
+	case scheme == "https" && !o.TLS:
+		return fmt.Errorf("management server scheme https needs the xds server to serve TLS")
+	case scheme == "http" && o.TLS:
+		return fmt.Errorf("management server scheme http can't reach the xds server as it serves TLS")
+	}
+	return nil
+}
+
+// validateURL returns an error unless the address is an http or https URL with a host and port
+func (o ManagementServerOptions) validateURL(address string) error {
+	u, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("invalid management server address %q: %w", address, err)
+	}
+	if err := o.validateScheme(u.Scheme); err != nil {
+		return fmt.Errorf("management server address %q: %w", address, err)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("management server address %q has no host", address)
+	}
+	if _, err := net.ParsePort(u.Port(), false); err != nil {
+		return fmt.Errorf("management server address %q needs a port: %w", address, err)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return fmt.Errorf("management server address %q must only have a scheme, host and port", address)
+	}
+	return nil
+}
+
+// SetManagementServers sets the management server URLs written into generated configs
+func SetManagementServers(urls []string) {
+	managementServers = urls
+}
+
+// ManagementServerPorts returns the ports of the management server URLs
+func ManagementServerPorts() []int {
+	ports := make([]int, 0, len(managementServers))
+	for _, address := range managementServers {
+		if u, err := url.Parse(address); err == nil {
+			if port, err := net.ParsePort(u.Port(), false); err == nil {
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quilkin
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestManagementServerURLs(t *testing.T) {
+	o := ManagementServerOptions{Service: "quilkin-controller", Namespace: "quilkin", ClusterDomain: "games.internal", Port: 18001, Scheme: "https", TLS: true}
+	urls, err := o.URLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"https://quilkin-controller.quilkin.svc.games.internal:18001"}; !reflect.DeepEqual(urls, want) {
+		t.Errorf("got %v, want %v", urls, want)
+	}
+
+	o.Addresses = []string{"https://10.0.0.1:18000", "https://10.0.0.2:18000"}
+	if urls, err = o.URLs(); err != nil || len(urls) != 2 {
+		t.Errorf("explicit addresses should be used: %v %v", urls, err)
+	}
+
+	for _, invalid := range []ManagementServerOptions{
+		{Namespace: "quilkin", ClusterDomain: "cluster.local", Port: 18000, Scheme: "http"},
+		{Service: "quilkin", Namespace: "quilkin", ClusterDomain: "cluster.local", Port: 0, Scheme: "http"},
+		{Service: "quilkin", Namespace: "quilkin", ClusterDomain: "cluster.local", Port: 18000, Scheme: "grpc"},
+		{Service: "quilkin", Namespace: "quilkin", ClusterDomain: "cluster.local", Port: 18000, Scheme: "https"},
+		{Service: "quilkin", Namespace: "quilkin", ClusterDomain: "cluster.local", Port: 18000, Scheme: "http", TLS: true},
+		{Addresses: []string{"10.0.0.1:18000"}},
+		{Addresses: []string{"http://10.0.0.1"}},
+		{Addresses: []string{"https://10.0.0.1:18000"}},
+		{Addresses: []string{"http://10.0.0.1:18000"}, TLS: true},
+	} {
+		if _, err := invalid.URLs(); err == nil {
+			t.Errorf("%+v should be invalid", invalid)
+		}
+	}
+}
+
+func TestManagementServerConfig(t *testing.T) {
+	SetManagementServers([]string{"http://10.0.0.1:18000", "http://[fd00::1]:18001"})
+	defer SetManagementServers(nil)
+	conf := NewQuilkinConfig("server")
+	if len(conf.Dynamic.ManagementServers) != 2 || conf.Dynamic.ManagementServers[1].Address != "http://[fd00::1]:18001" {
+		t.Errorf("unexpected management servers %v", conf.Dynamic.ManagementServers)
+	}
+	if ports := ManagementServerPorts(); !reflect.DeepEqual(ports, []int{18000, 18001}) {
+		t.Errorf("unexpected ports %v", ports)
+	}
+}
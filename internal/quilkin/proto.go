@@ -0,0 +1,58 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quilkin
+
+import "google.golang.org/protobuf/encoding/protowire"
+
+// The quilkin filter protos aren't published as a go module so the filter configs are
+// encoded by hand. These helpers follow proto3 rules where scalar zero values are omitted.
+
+// appendVarint appends a varint field if the value isn't zero
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendBool appends a bool field if it is true
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	return appendVarint(b, num, protowire.EncodeBool(v))
+}
+
+// appendString appends a string field if it isn't empty
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendMessage appends an embedded message field. Unlike scalars the field is always written
+// as an empty message still marks the field as set.
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// appendEnumValue appends a message wrapping an enum in its first field, the pattern quilkin
+// uses so enum fields can be unset
+func appendEnumValue(b []byte, num protowire.Number, v uint64) []byte {
+	return appendMessage(b, num, appendVarint(nil, 1, v))
+}
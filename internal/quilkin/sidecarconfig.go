@@ -0,0 +1,121 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quilkin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"sigs.k8s.io/yaml"
+)
+
+// SidecarConfig is the config of a single workload's sender sidecar, overriding the settings of its proxy
+type SidecarConfig struct {
+	// Port is the port the sidecar listens on
+	Port int `json:"port,omitempty"`
+	// AdminPort is the admin port of the sidecar
+	AdminPort int `json:"adminPort,omitempty"`
+	// Filters replaces the filter chain of the proxy when set, an empty list removes every filter
+	Filters []FilterSpec `json:"filters,omitempty"`
+	// RateLimit replaces the LocalRateLimit filter of the chain, or is added first when it has none
+	RateLimit *LocalRateLimit `json:"rateLimit,omitempty"`
+}
+
+// FilterSpec is a single filter of a sidecar filter chain. Exactly one field must be set.
+type FilterSpec struct {
+	Compress       *Compress       `json:"compress,omitempty"`
+	CaptureBytes   *CaptureBytes   `json:"captureBytes,omitempty"`
+	LocalRateLimit *LocalRateLimit `json:"localRateLimit,omitempty"`
+}
+
+// filter returns the filter set, or nil unless exactly one is set
+func (f FilterSpec) filter() Filter {
+	var set []Filter
+	if f.Compress != nil {
+		set = append(set, f.Compress)
+	}
+	if f.CaptureBytes != nil {
+		set = append(set, f.CaptureBytes)
+	}
+	if f.LocalRateLimit != nil {
+		set = append(set, f.LocalRateLimit)
+	}
+	if len(set) != 1 {
+		return nil
+	}
+	return set[0]
+}
+
+// ParseSidecarConfig parses and validates a sidecar config written as YAML or JSON
+func ParseSidecarConfig(data string) (*SidecarConfig, error) {
+	config := &SidecarConfig{}
+	if err := yaml.UnmarshalStrict([]byte(data), config); err != nil {
+		return nil, err
+	}
+	for name, port := range map[string]int{"port": config.Port, "adminPort": config.AdminPort} {
+		if port < 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s %d", name, port)
+		}
+	}
+	if _, err := config.FilterChain(); err != nil {
+		return nil, err
+	}
+	if config.RateLimit != nil {
+		if err := config.RateLimit.Validate(); err != nil {
+			return nil, fmt.Errorf("rateLimit: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// FilterChain returns the validated filter chain of the sidecar, nil when it uses the chain of its proxy
+func (c *SidecarConfig) FilterChain() ([]Filter, error) {
+	if c.Filters == nil {
+		return nil, nil
+	}
+	chain := make([]Filter, 0, len(c.Filters))
+	for i, spec := range c.Filters {
+		filter := spec.filter()
+		if filter == nil {
+			return nil, fmt.Errorf("filter %d must set exactly one filter type", i)
+		}
+		chain = append(chain, filter)
+	}
+	if err := ValidateFilters(chain); err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+// VariantKey returns a key identifying the filter chain and rate limit of the sidecar, or an empty string
+// when it uses the chain of its proxy. Sidecars with the same chain and rate limit share a key.
+func (c *SidecarConfig) VariantKey() string {
+	chain, err := c.FilterChain()
+	if err != nil || (chain == nil && c.RateLimit == nil) {
+		return ""
+	}
+	h := sha256.New()
+	for _, filter := range chain {
+		fmt.Fprintf(h, "%s:%x;", filter.Name(), filter.MarshalProto())
+	}
+	if c.RateLimit != nil {
+		// Tells a rate limit on the proxy's chain from one on an empty chain of the sidecar's own
+		fmt.Fprintf(h, "rateLimit:%t:%x;", chain != nil, c.RateLimit.MarshalProto())
+	}
+	return hex.EncodeToString(h.Sum(nil))[:10]
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quilkin
+
+import "testing"
+
+func TestParseSidecarConfig(t *testing.T) {
+	config, err := ParseSidecarConfig(`{"port": 7100, "filters": [{"compress": {"onRead": "Compress"}}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Port != 7100 || config.VariantKey() == "" {
+		t.Errorf("unexpected config %+v", config)
+	}
+	same, err := ParseSidecarConfig("filters:\n- compress:\n    onRead: Compress\n")
+	if err != nil || same.VariantKey() != config.VariantKey() {
+		t.Error("configs with the same filters should share a variant")
+	}
+	if ports, _ := ParseSidecarConfig(`{"adminPort": 9100}`); ports == nil || ports.VariantKey() != "" {
+		t.Error("configs without filters should use the proxy's chain")
+	}
+	limited, err := ParseSidecarConfig(`{"rateLimit": {"maxPackets": 50, "period": "1s"}}`)
+	if err != nil || limited.VariantKey() == "" {
+		t.Errorf("rate limited sidecars need their own variant: %v", err)
+	}
+
+	for _, invalid := range []string{
+		`{"port": 70000}`,
+		`{"unknown": true}`,
+		`{"filters": [{}]}`,
+		`{"filters": [{"compress": {"onRead": "Zip"}}]}`,
+		`{"filters": [{"compress": {}, "captureBytes": {"size": 2}}]}`,
+		`{"rateLimit": {"maxPackets": 0}}`,
+		`{"filters": [{"localRateLimit": {"maxPackets": 10, "period": "10ms"}}]}`,
+	} {
+		if _, err := ParseSidecarConfig(invalid); err == nil {
+			t.Errorf("%s should be invalid", invalid)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quilkin
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+// Generator renders a config in the format a range of quilkin versions accepts
+type Generator func(config QuilkinConfig) ([]byte, error)
+
+// generatorRange is a generator and the quilkin versions from min up to but excluding max it supports
+type generatorRange struct {
+	min       *version.Version
+	max       *version.Version
+	generator Generator
+}
+
+var generators []generatorRange
+
+// filterVersions are the quilkin versions filters were added in. Filters not listed are in every supported version.
+var filterVersions = map[string]*version.Version{
+	// The firewall filter was released with quilkin 0.3.0
+	FirewallFilterName: version.MustParseGeneric("0.3.0"),
+}
+
+func init() {
+	RegisterGenerator("0.1.0", "0.3.0", generateV1Alpha1)
+}
+
+// RegisterGenerator registers the generator used for quilkin versions from min up to but excluding max.
+// An empty max leaves the range unbounded.
+func RegisterGenerator(min string, max string, generator Generator) {
+	r := generatorRange{min: version.MustParseGeneric(min), generator: generator}
+	if max != "" {
+		r.max = version.MustParseGeneric(max)
+	}
+	generators = append(generators, r)
+}
+
+// GeneratorFor returns the generator for the quilkin version provided
+func GeneratorFor(v string) (Generator, error) {
+	parsed, err := version.ParseGeneric(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid quilkin version %q: %w", v, err)
+	}
+	for _, r := range generators {
+		if parsed.LessThan(r.min) {
+			continue
+		}
+		if r.max == nil || parsed.LessThan(r.max) {
+			return r.generator, nil
+		}
+	}
+	return nil, fmt.Errorf("quilkin version %s is not supported, supported versions are %s", v, SupportedVersions())
+}
+
+// CheckFilters returns an error if a filter of the chain isn't available in the quilkin version provided
+func CheckFilters(filters []Filter, v string) error {
+	parsed, err := version.ParseGeneric(v)
+	if err != nil {
+		return fmt.Errorf("invalid quilkin version %q: %w", v, err)
+	}
+	for _, filter := range filters {
+		if min, ok := filterVersions[filter.Name()]; ok && parsed.LessThan(min) {
+			return fmt.Errorf("filter %s needs quilkin %s or later but the proxy runs %s", filter.Name(), min, v)
+		}
+	}
+	return nil
+}
+
+// SupportedVersions describes the quilkin versions configs can be generated for
+func SupportedVersions() string {
+	ranges := make([]string, 0, len(generators))
+	for _, r := range generators {
+		if r.max == nil {
+			ranges = append(ranges, ">= "+r.min.String())
+		} else {
+			ranges = append(ranges, ">= "+r.min.String()+" < "+r.max.String())
+		}
+	}
+	return strings.Join(ranges, ", ")
+}
+
+// ImageVersion returns the quilkin version in the tag of the image provided
+func ImageVersion(image string) (string, error) {
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	i := strings.LastIndex(name, ":")
+	if i < 0 || strings.Contains(name[i:], "/") {
+		return "", fmt.Errorf("image %s has no tag to read the quilkin version from, set the version explicitly", image)
+	}
+	tag := name[i+1:]
+	if _, err := version.ParseGeneric(tag); err != nil {
+		return "", fmt.Errorf("tag of image %s is not a quilkin version, set the version explicitly", image)
+	}
+	return tag, nil
+}
+
+// Render renders the config for the quilkin version provided
+func Render(config QuilkinConfig, v string) ([]byte, error) {
+	generator, err := GeneratorFor(v)
+	if err != nil {
+		return nil, err
+	}
+	return generator(config)
+}
+
+// generateV1Alpha1 renders the v1alpha1 config format of quilkin 0.1 and 0.2
+func generateV1Alpha1(config QuilkinConfig) ([]byte, error) {
+	config.Version = "v1alpha1"
+	return yaml.Marshal(config)
+}
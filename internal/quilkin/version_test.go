@@ -0,0 +1,65 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quilkin
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestImageVersion(t *testing.T) {
+	for image, want := range map[string]string{
+		"us-docker.pkg.dev/quilkin/release/quilkin:0.2.0":         "0.2.0",
+		"localhost:5000/quilkin:v0.1.1":                           "v0.1.1",
+		"quilkin:0.2.0@sha256:0123456789abcdef0123456789abcdef01": "0.2.0",
+	} {
+		if got, err := ImageVersion(image); err != nil || got != want {
+			t.Errorf("%s: got %q, %v", image, got, err)
+		}
+	}
+	for _, image := range []string{"localhost:5000/quilkin", "quilkin:latest"} {
+		if _, err := ImageVersion(image); err == nil {
+			t.Errorf("%s should have no version", image)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	out, err := Render(NewQuilkinConfig("server"), "0.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte("version: v1alpha1")) {
+		t.Errorf("unexpected config:\n%s", out)
+	}
+	if _, err := Render(NewQuilkinConfig("server"), "0.3.0"); err == nil {
+		t.Error("unsupported versions should be refused")
+	}
+}
+
+func TestCheckFilters(t *testing.T) {
+	chain := []Filter{&Compress{OnRead: "Compress"}, &Firewall{Sources: []string{"10.0.0.0/8"}}}
+	if err := CheckFilters(chain[:1], "0.1.0"); err != nil {
+		t.Errorf("compress should be available in every supported version: %v", err)
+	}
+	if err := CheckFilters(chain, "0.2.0"); err == nil {
+		t.Error("the firewall filter should need a newer quilkin")
+	}
+	if err := CheckFilters(chain, "0.3.0"); err != nil {
+		t.Errorf("the firewall filter should be available once released: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"net"
+	"sort"
+
+	"github.com/nfowl/quilkin-controller/internal/quilkin"
+)
+
+// Firewall restricts the receiver side proxies of a proxy to packets from its senders
+type Firewall struct {
+	// CIDRs are allowed in addition to the addresses of the senders
+	CIDRs []string
+}
+
+// setSenderAddress records the address of a sender pod of a proxy and returns whether it changed.
+// An empty address removes it. Must be called with the lock held.
+func (s *SotwStore) setSenderAddress(proxyName string, podName string, address string) bool {
+	addresses, ok := s.senderAddresses[proxyName]
+	if address == "" {
+		if !ok {
+			return false
+		}
+		if _, ok := addresses[podName]; !ok {
+			return false
+		}
+		delete(addresses, podName)
+		if len(addresses) == 0 {
+			delete(s.senderAddresses, proxyName)
+		}
+		return true
+	}
+	if !ok {
+		addresses = make(map[string]string)
+		s.senderAddresses[proxyName] = addresses
+	}
+	if addresses[podName] == address {
+		return false
+	}
+	addresses[podName] = address
+	return true
+}
+
+// firewallFilter returns the Firewall filter of the receiver side proxies of a proxy, nil when it has no
+// firewall. Must be called with the lock held.
+func (s *SotwStore) firewallFilter(proxyName string) quilkin.Filter {
+	firewall := s.filters[proxyName].Firewall
+	if firewall == nil {
+		return nil
+	}
+	seen := make(map[string]struct{})
+	sources := make([]string, 0, len(s.senderAddresses[proxyName])+len(firewall.CIDRs))
+	add := func(source string) {
+		if _, ok := seen[source]; !ok {
+			seen[source] = struct{}{}
+			sources = append(sources, source)
+		}
+	}
+	for _, address := range s.senderAddresses[proxyName] {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			add(ip.String() + "/32")
+		} else {
+			add(ip.String() + "/128")
+		}
+	}
+	for _, cidr := range firewall.CIDRs {
+		add(cidr)
+	}
+	sort.Strings(sources)
+	return &quilkin.Firewall{Sources: sources}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+// NodeProxyPrefix is prepended to the xds node id of node local proxies
+const NodeProxyPrefix = "node/"
+
+// NodeProxyID returns the xds node id used by the node local proxy of a proxy on the kubernetes node provided
+func NodeProxyID(nodeName string, proxyName string) string {
+	return NodeProxyPrefix + nodeName + "/" + proxyName
+}
+
+// AddNodeSender records a sender pod that uses the node local proxies of the kubernetes node provided to send
+// to the proxy provided. A pod sending to several proxies is added once per proxy. The node local proxy of the
+// proxy is sent the endpoints and sender filters of that proxy only.
+func (s *SotwStore) AddNodeSender(nodeName string, proxyName string, podName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	senders, ok := s.nodeSenders[nodeName]
+	if !ok {
+		senders = make(map[string][]string)
+		s.nodeSenders[nodeName] = senders
+	}
+	if !containsProxy(senders[podName], proxyName) {
+		senders[podName] = append(senders[podName], proxyName)
+	}
+	s.logger.Infow("Added node sender", "node", nodeName, "proxy", proxyName, "pod", podName)
+	s.nodeUpdates <- s.nodeProxy(nodeName, proxyName)
+}
+
+// RemoveNodeSender removes a sender pod from the node local proxies of the kubernetes node provided
+func (s *SotwStore) RemoveNodeSender(nodeName string, podName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	senders, ok := s.nodeSenders[nodeName]
+	if !ok {
+		return
+	}
+	if _, ok := senders[podName]; !ok {
+		return
+	}
+	delete(senders, podName)
+	s.logger.Infow("Removed node sender", "node", nodeName, "pod", podName)
+	if len(senders) == 0 {
+		delete(s.nodeSenders, nodeName)
+	}
+}
+
+// updateNodeProxies sends a new config to the node local proxies of the proxy provided on every node it is
+// used on. Must be called with the lock held.
+func (s *SotwStore) updateNodeProxies(proxyName string) {
+	for nodeName, senders := range s.nodeSenders {
+		for _, used := range senders {
+			if containsProxy(used, proxyName) {
+				s.nodeUpdates <- s.nodeProxy(nodeName, proxyName)
+				break
+			}
+		}
+	}
+}
+
+// containsProxy returns whether the proxy is in the list provided
+func containsProxy(proxies []string, proxyName string) bool {
+	for _, p := range proxies {
+		if p == proxyName {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeProxy builds the config of the node local proxy of a proxy from its endpoints and sender filters.
+// Must be called with the lock held.
+func (s *SotwStore) nodeProxy(nodeName string, proxyName string) NodeConfig {
+	endpoints := make(map[string]*Endpoint)
+	if node, ok := s.Nodes[proxyName]; ok {
+		for key, endpoint := range node.Endpoints {
+			e := *endpoint
+			endpoints[key] = &e
+		}
+	}
+	return NodeConfig{
+		ProxyName: NodeProxyID(nodeName, proxyName),
+		Endpoints: endpoints,
+		Filters:   s.filters[proxyName].Sender,
+		senders:   make(map[string]struct{}),
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"strconv"
+
+	"github.com/nfowl/quilkin-controller/internal/quilkin"
+)
+
+// ReceiverProxyPrefix is prepended to the xds node id of receiver side proxies
+const ReceiverProxyPrefix = "receiver/"
+
+// ReceiverProxyID returns the xds node id of the receiver side proxies of a proxy that forward
+// to the local port provided. Every receiver pod sharing the proxy and port shares the config.
+func ReceiverProxyID(proxyName string, port int) string {
+	return ReceiverProxyPrefix + proxyName + "/" + strconv.Itoa(port)
+}
+
+// receiverProxy tracks the receiver pods running a receiver side proxy with the same config
+type receiverProxy struct {
+	proxyName string
+	port      int
+	pods      map[string]struct{}
+}
+
+// AddReceiverProxy records a receiver pod running a receiver side proxy that forwards packets to
+// the local port provided after applying the receiver filters of the proxy.
+func (s *SotwStore) AddReceiverProxy(proxyName string, port int, podName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := ReceiverProxyID(proxyName, port)
+	receiver, ok := s.receiverProxies[id]
+	if !ok {
+		receiver = &receiverProxy{proxyName: proxyName, port: port, pods: make(map[string]struct{})}
+		s.receiverProxies[id] = receiver
+	}
+	receiver.pods[podName] = struct{}{}
+	s.logger.Infow("Added receiver proxy", "id", id, "pod", podName)
+	s.nodeUpdates <- s.receiverNode(receiver)
+}
+
+// RemoveReceiverProxy removes a receiver pod from the receiver side proxies of a proxy
+func (s *SotwStore) RemoveReceiverProxy(proxyName string, podName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, receiver := range s.receiverProxies {
+		if receiver.proxyName != proxyName {
+			continue
+		}
+		if _, ok := receiver.pods[podName]; !ok {
+			continue
+		}
+		delete(receiver.pods, podName)
+		s.logger.Infow("Removed receiver proxy", "id", id, "pod", podName)
+		if len(receiver.pods) == 0 {
+			delete(s.receiverProxies, id)
+		}
+	}
+}
+
+// updateReceiverProxies sends a new config to every receiver side proxy of the proxy provided.
+// Must be called with the lock held.
+func (s *SotwStore) updateReceiverProxies(proxyName string) {
+	for _, receiver := range s.receiverProxies {
+		if receiver.proxyName == proxyName {
+			s.nodeUpdates <- s.receiverNode(receiver)
+		}
+	}
+}
+
+// receiverNode builds the config of a receiver side proxy, which only forwards to the local receiver.
+// Must be called with the lock held.
+func (s *SotwStore) receiverNode(receiver *receiverProxy) NodeConfig {
+	filters := s.filters[receiver.proxyName].Receiver
+	if firewall := s.firewallFilter(receiver.proxyName); firewall != nil {
+		filters = append([]quilkin.Filter{firewall}, filters...)
+	}
+	return NodeConfig{
+		ProxyName: ReceiverProxyID(receiver.proxyName, receiver.port),
+		Endpoints: map[string]*Endpoint{"local": {Address: "127.0.0.1", Port: receiver.port}},
+		Filters:   filters,
+		senders:   make(map[string]struct{}),
+	}
+}
@@ -17,8 +17,11 @@ limitations under the License.
 package store
 
 import (
+	"reflect"
+	"strings"
 	"sync"
 
+	"github.com/nfowl/quilkin-controller/internal/quilkin"
 	"go.uber.org/zap"
 )
 
@@ -30,23 +33,57 @@ type SotwStore struct {
 	Nodes       map[string]*NodeConfig
 	nodeUpdates chan NodeConfig
 	nodeDeletes chan string
-	logger      *zap.SugaredLogger
+	watchers    []*Watcher
+	// nodeSenders maps kubernetes nodes to the sender pods on them and the proxies each pod uses
+	nodeSenders map[string]map[string][]string
+	// receiverProxies are the receiver side proxies keyed by their xds node id
+	receiverProxies map[string]*receiverProxy
+	// senderVariants are the sender proxies with their own filter chain keyed by their xds node id
+	senderVariants map[string]*senderVariant
+	// senderAddresses maps proxies to their sender pods and the address of each
+	senderAddresses map[string]map[string]string
+	// filters are the filter chains configured for each proxy
+	filters map[string]ProxyFilters
+	logger  *zap.SugaredLogger
 }
 
 func NewSotWStore(updates chan NodeConfig, deletes chan string, logger *zap.SugaredLogger) *SotwStore {
 	nodes := make(map[string]*NodeConfig)
-	return &SotwStore{Nodes: nodes, nodeUpdates: updates, nodeDeletes: deletes, logger: logger}
+	return &SotwStore{Nodes: nodes, nodeUpdates: updates, nodeDeletes: deletes, nodeSenders: make(map[string]map[string][]string),
+		receiverProxies: make(map[string]*receiverProxy), senderVariants: make(map[string]*senderVariant),
+		senderAddresses: make(map[string]map[string]string), filters: make(map[string]ProxyFilters), logger: logger}
 }
 
 type NodeConfig struct {
 	Endpoints map[string]*Endpoint
 	ProxyName string
-	senders   map[string]struct{}
+	// Filters is the filter chain served to the proxy
+	Filters []quilkin.Filter
+	senders map[string]struct{}
+}
+
+// ProxyAck is a proxy that acknowledged a config with endpoints. Proxies share node ids so the IP
+// of the proxy tells them apart.
+type ProxyAck struct {
+	IP     string
+	NodeID string
+}
+
+// ProxyFilters are the filter chains configured for a proxy
+type ProxyFilters struct {
+	// Sender is served to the proxies senders use
+	Sender []quilkin.Filter
+	// Receiver is served to the receiver side proxies injected into receivers
+	Receiver []quilkin.Filter
+	// Firewall is added first to the receiver chain unless nil
+	Firewall *Firewall
 }
 
 type Endpoint struct {
 	Address string
 	Port    int
+	// Weight is the relative load balancing weight of the endpoint. 0 leaves it unset.
+	Weight uint32
 }
 
 func (s *SotwStore) AddReceiver(proxyName string, port int, address string, podName string) {
@@ -64,10 +101,12 @@ func (s *SotwStore) AddReceiver(proxyName string, port int, address string, podN
 		value.Endpoints[podName] = &Endpoint{Address: address, Port: port}
 	}
 	s.logger.Infow("Added receiver endpoint", "node", proxyName, "endpoints", value.Endpoints)
-	s.nodeUpdates <- *value
+	s.notify(proxyName)
+	s.send(value)
 }
 
-func (s *SotwStore) AddSender(proxyName string, podName string) {
+// AddSender records a sender pod of a proxy and its address, which may be empty while the pod has none
+func (s *SotwStore) AddSender(proxyName string, podName string, address string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	value, ok := s.Nodes[proxyName]
@@ -79,7 +118,11 @@ func (s *SotwStore) AddSender(proxyName string, podName string) {
 	}
 	value.senders[podName] = struct{}{}
 	s.logger.Infow("Added sender", "name", proxyName, "remaining", len(value.senders))
-	s.nodeUpdates <- *value
+	s.notify(proxyName)
+	s.send(value)
+	if s.setSenderAddress(proxyName, podName, address) && s.filters[proxyName].Firewall != nil {
+		s.updateReceiverProxies(proxyName)
+	}
 }
 
 // RemoveReceiver deletes a receiver from a node if it exists.
@@ -93,9 +136,11 @@ func (s *SotwStore) RemoveReceiver(proxyName string, podName string) {
 		s.logger.Infow("Deleting receiver endpoint", "proxyName", proxyName, "receiver", podName)
 		if len(value.senders) == 0 && len(value.Endpoints) == 0 {
 			delete(s.Nodes, proxyName)
+			s.notify(proxyName)
 			return
 		}
-		s.nodeUpdates <- *s.Nodes[proxyName]
+		s.notify(proxyName)
+		s.send(s.Nodes[proxyName])
 	}
 }
 
@@ -104,10 +149,14 @@ func (s *SotwStore) RemoveReceiver(proxyName string, podName string) {
 func (s *SotwStore) RemoveSender(proxyName string, podName string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.setSenderAddress(proxyName, podName, "") && s.filters[proxyName].Firewall != nil {
+		s.updateReceiverProxies(proxyName)
+	}
 	node, ok := s.Nodes[proxyName]
 	if ok {
 		delete(node.senders, podName)
 		s.logger.Infow("removed sender", "name", proxyName, "remaining", len(node.senders))
+		s.notify(proxyName)
 		if len(node.senders) <= 0 {
 			// Only delete the nodeconfig if all receivers are also empty
 			if len(node.Endpoints) == 0 {
@@ -119,3 +168,162 @@ func (s *SotwStore) RemoveSender(proxyName string, podName string) bool {
 	}
 	return false
 }
+
+// SetReceivers replaces every endpoint added to a node by the source provided with the passed endpoints.
+// Endpoints are keyed by source so multiple sources can contribute to the same proxy without clobbering
+// each other or the pod receivers. The xds server is notified of the change, nothing happens if the source
+// already has exactly these endpoints. Returns whether the endpoints changed.
+func (s *SotwStore) SetReceivers(proxyName string, source string, endpoints map[string]*Endpoint) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.Nodes[proxyName]
+	if !ok {
+		if len(endpoints) == 0 {
+			return false
+		}
+		value = &NodeConfig{ProxyName: proxyName, Endpoints: make(map[string]*Endpoint), senders: make(map[string]struct{})}
+		s.Nodes[proxyName] = value
+	} else if sourceEndpointsEqual(value, source, endpoints) {
+		return false
+	}
+	removeSource(value, source)
+	for key, endpoint := range endpoints {
+		value.Endpoints[sourceKey(source, key)] = endpoint
+	}
+	s.logger.Infow("Set receiver endpoints", "node", proxyName, "source", source, "endpoints", len(endpoints))
+	if len(value.senders) == 0 && len(value.Endpoints) == 0 {
+		delete(s.Nodes, proxyName)
+		s.notify(proxyName)
+		return true
+	}
+	s.notify(proxyName)
+	s.send(value)
+	return true
+}
+
+// RemoveReceivers deletes every endpoint added to a node by the source provided.
+// The xds server is notified of the change if one occurs
+func (s *SotwStore) RemoveReceivers(proxyName string, source string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.Nodes[proxyName]
+	if !ok || !removeSource(value, source) {
+		return
+	}
+	s.logger.Infow("Deleting receiver endpoints", "proxyName", proxyName, "source", source)
+	if len(value.senders) == 0 && len(value.Endpoints) == 0 {
+		delete(s.Nodes, proxyName)
+		s.notify(proxyName)
+		return
+	}
+	s.notify(proxyName)
+	s.send(value)
+}
+
+// removeSource deletes all endpoints belonging to a source from the node and returns whether any were removed
+func removeSource(node *NodeConfig, source string) bool {
+	removed := false
+	prefix := sourceKey(source, "")
+	for key := range node.Endpoints {
+		if strings.HasPrefix(key, prefix) {
+			delete(node.Endpoints, key)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// sourceEndpointsEqual returns whether the endpoints a source added to the node are exactly the ones provided
+func sourceEndpointsEqual(node *NodeConfig, source string, endpoints map[string]*Endpoint) bool {
+	prefix := sourceKey(source, "")
+	count := 0
+	for key, endpoint := range node.Endpoints {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		count++
+		other, ok := endpoints[strings.TrimPrefix(key, prefix)]
+		if !ok || *other != *endpoint {
+			return false
+		}
+	}
+	return count == len(endpoints)
+}
+
+// sourceKey builds the endpoint key for an endpoint added by a source.
+// Pod names cannot contain a "/" so these never collide with pod receivers.
+func sourceKey(source string, key string) string {
+	return source + "/" + key
+}
+
+// Watch returns a watcher collecting the name of a proxy every time its node changes or is removed
+func (s *SotwStore) Watch() *Watcher {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	watcher := newWatcher()
+	s.watchers = append(s.watchers, watcher)
+	return watcher
+}
+
+// Node returns a copy of the node for the proxy provided and whether it exists
+func (s *SotwStore) Node(proxyName string) (NodeConfig, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.Nodes[proxyName]
+	if !ok {
+		return NodeConfig{}, false
+	}
+	endpoints := make(map[string]*Endpoint, len(value.Endpoints))
+	for key, endpoint := range value.Endpoints {
+		e := *endpoint
+		endpoints[key] = &e
+	}
+	senders := make(map[string]struct{}, len(value.senders))
+	for key := range value.senders {
+		senders[key] = struct{}{}
+	}
+	return NodeConfig{ProxyName: value.ProxyName, Endpoints: endpoints, senders: senders}, true
+}
+
+// notify tells every watcher the proxy provided has changed and refreshes the node proxies using it.
+// Must be called with the lock held.
+func (s *SotwStore) notify(proxyName string) {
+	for _, watcher := range s.watchers {
+		watcher.add(proxyName)
+	}
+	s.updateNodeProxies(proxyName)
+	s.updateSenderVariants(proxyName)
+}
+
+// SetFilters sets the filter chains of a proxy. The proxy and its receiver side proxies are sent
+// the new chains if they exist and the chains changed.
+func (s *SotwStore) SetFilters(proxyName string, filters ProxyFilters) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, ok := s.filters[proxyName]; ok && reflect.DeepEqual(current, filters) {
+		return
+	}
+	if len(filters.Sender) == 0 && len(filters.Receiver) == 0 && filters.Firewall == nil {
+		if _, ok := s.filters[proxyName]; !ok {
+			return
+		}
+		delete(s.filters, proxyName)
+	} else {
+		s.filters[proxyName] = filters
+	}
+	s.logger.Infow("Set proxy filters", "proxy", proxyName, "sender", len(filters.Sender), "receiver", len(filters.Receiver))
+	if node, ok := s.Nodes[proxyName]; ok {
+		s.send(node)
+	}
+	s.updateReceiverProxies(proxyName)
+	s.updateSenderVariants(proxyName)
+	s.updateNodeProxies(proxyName)
+}
+
+// send pushes a node to the xds server along with the sender filters of its proxy.
+// Must be called with the lock held.
+func (s *SotwStore) send(node *NodeConfig) {
+	update := *node
+	update.Filters = s.filters[node.ProxyName].Sender
+	s.nodeUpdates <- update
+}
@@ -20,6 +20,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/nfowl/quilkin-controller/internal/quilkin"
 	"go.uber.org/zap"
 )
 
@@ -51,7 +52,7 @@ func TestSenderInteractions(t *testing.T) {
 	deletes := make(chan string)
 	store := NewSotWStore(updates, deletes, zap.L().Sugar())
 	//Add Sender
-	go store.AddSender("test", "pod-10")
+	go store.AddSender("test", "pod-10", "")
 	timer := time.NewTimer(time.Second / 2)
 	select {
 	case data := <-updates:
@@ -63,7 +64,7 @@ func TestSenderInteractions(t *testing.T) {
 		t.Error("Should return update")
 	}
 
-	go store.AddSender("test", "pod-11")
+	go store.AddSender("test", "pod-11", "")
 	timer = time.NewTimer(time.Second / 2)
 	select {
 	case data := <-updates:
@@ -185,7 +186,7 @@ func TestMixedStore(t *testing.T) {
 	store := NewSotWStore(updates, deletes, zap.L().Sugar())
 
 	//Add Sender
-	go store.AddSender("test", "pod-10")
+	go store.AddSender("test", "pod-10", "")
 	timer := time.NewTimer(time.Second / 2)
 	select {
 	case data := <-updates:
@@ -266,3 +267,315 @@ func TestMixedStore(t *testing.T) {
 		}
 	}
 }
+
+func TestSourceReceivers(t *testing.T) {
+	t.Parallel()
+	updates := make(chan NodeConfig)
+	deletes := make(chan string)
+	store := NewSotWStore(updates, deletes, zap.L().Sugar())
+
+	// Add a pod receiver alongside the source
+	go store.AddReceiver("test", 1000, "10.0.0.1", "pod-1")
+	<-updates
+
+	go store.SetReceivers("test", "svc", map[string]*Endpoint{"a": {Address: "10.0.1.1", Port: 2000}, "b": {Address: "10.0.1.2", Port: 2000}})
+	timer := time.NewTimer(time.Second / 2)
+	select {
+	case data := <-updates:
+		if len(data.Endpoints) != 3 {
+			t.Error("mismatch")
+		}
+	case <-timer.C:
+		t.Error("Should return update")
+	}
+
+	// Setting the same endpoints again is a no op
+	if store.SetReceivers("test", "svc", map[string]*Endpoint{"a": {Address: "10.0.1.1", Port: 2000}, "b": {Address: "10.0.1.2", Port: 2000}}) {
+		t.Error("unchanged endpoints shouldn't be reported as changed")
+	}
+
+	// Replacing the source only affects its own endpoints
+	go store.SetReceivers("test", "svc", map[string]*Endpoint{"c": {Address: "10.0.1.3", Port: 2000}})
+	timer = time.NewTimer(time.Second / 2)
+	select {
+	case data := <-updates:
+		if len(data.Endpoints) != 2 {
+			t.Error("mismatch")
+		}
+		if _, ok := data.Endpoints["pod-1"]; !ok {
+			t.Error("pod receiver should remain")
+		}
+	case <-timer.C:
+		t.Error("Should return update")
+	}
+
+	go store.RemoveReceivers("test", "svc")
+	timer = time.NewTimer(time.Second / 2)
+	select {
+	case data := <-updates:
+		if len(data.Endpoints) != 1 {
+			t.Error("mismatch")
+		}
+	case <-timer.C:
+		t.Error("Should return update")
+	}
+
+	// Removing an unknown source is a no op
+	go store.RemoveReceivers("test", "svc")
+	timer = time.NewTimer(time.Second / 2)
+	select {
+	case <-updates:
+		t.Error("Shouldn't return update")
+	case <-timer.C:
+		break
+	}
+}
+
+func TestNodeSenders(t *testing.T) {
+	t.Parallel()
+	updates := make(chan NodeConfig)
+	deletes := make(chan string)
+	store := NewSotWStore(updates, deletes, zap.L().Sugar())
+
+	go store.AddReceiver("game", 1000, "10.0.0.1", "pod-1")
+	<-updates
+	go store.AddReceiver("telemetry", 2000, "10.0.0.2", "pod-2")
+	<-updates
+
+	go store.AddNodeSender("node-a", "game", "sender-1")
+	timer := time.NewTimer(time.Second / 2)
+	select {
+	case data := <-updates:
+		if data.ProxyName != NodeProxyID("node-a", "game") || len(data.Endpoints) != 1 || data.Endpoints["pod-1"] == nil {
+			t.Error("node proxy should only get the endpoints of its proxy")
+		}
+	case <-timer.C:
+		t.Error("Should return update")
+	}
+
+	go store.AddNodeSender("node-a", "telemetry", "sender-1")
+	timer = time.NewTimer(time.Second / 2)
+	select {
+	case data := <-updates:
+		if data.ProxyName != NodeProxyID("node-a", "telemetry") || len(data.Endpoints) != 1 || data.Endpoints["pod-2"] == nil {
+			t.Error("each proxy used on the node should get its own node proxy")
+		}
+	case <-timer.C:
+		t.Error("Should return update")
+	}
+
+	// Changing a proxy used on the node updates its node proxy as well as the proxy
+	go store.AddReceiver("game", 1000, "10.0.0.3", "pod-3")
+	received := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		timer = time.NewTimer(time.Second / 2)
+		select {
+		case data := <-updates:
+			received[data.ProxyName] = len(data.Endpoints)
+		case <-timer.C:
+			t.Error("Should return update")
+		}
+	}
+	if received["game"] != 2 || received[NodeProxyID("node-a", "game")] != 2 {
+		t.Errorf("mismatch %v", received)
+	}
+
+	// Filters of a proxy are served to its node proxies
+	go store.SetFilters("telemetry", ProxyFilters{Sender: []quilkin.Filter{&quilkin.Compress{OnRead: "Compress"}}})
+	timer = time.NewTimer(time.Second / 2)
+	for {
+		select {
+		case data := <-updates:
+			if data.ProxyName != NodeProxyID("node-a", "telemetry") {
+				continue
+			}
+			if len(data.Filters) != 1 {
+				t.Error("node proxy should be sent the sender filters of its proxy")
+			}
+		case <-timer.C:
+			t.Error("Should return update")
+		}
+		break
+	}
+
+	// Removed senders no longer keep their proxies on the node
+	store.RemoveNodeSender("node-a", "sender-1")
+	go store.AddReceiver("telemetry", 2000, "10.0.0.4", "pod-4")
+	<-updates
+	timer = time.NewTimer(time.Second / 2)
+	select {
+	case data := <-updates:
+		t.Errorf("unused node proxies shouldn't be updated, got %s", data.ProxyName)
+	case <-timer.C:
+	}
+}
+
+func TestReceiverProxyFilters(t *testing.T) {
+	t.Parallel()
+	updates := make(chan NodeConfig)
+	deletes := make(chan string)
+	store := NewSotWStore(updates, deletes, zap.L().Sugar())
+
+	go store.AddReceiverProxy("game", 7777, "pod-1")
+	data := <-updates
+	if data.ProxyName != ReceiverProxyID("game", 7777) || data.Endpoints["local"].Port != 7777 || len(data.Filters) != 0 {
+		t.Error("receiver proxy should forward to the local port")
+	}
+
+	decompress := &quilkin.Compress{OnRead: "Decompress"}
+	go store.SetFilters("game", ProxyFilters{Receiver: []quilkin.Filter{decompress}})
+	timer := time.NewTimer(time.Second / 2)
+	select {
+	case data := <-updates:
+		if data.ProxyName != ReceiverProxyID("game", 7777) || len(data.Filters) != 1 {
+			t.Error("receiver proxy should be sent the receiver filters")
+		}
+	case <-timer.C:
+		t.Error("Should return update")
+	}
+
+	// Setting the same filters again is a no op
+	go store.SetFilters("game", ProxyFilters{Receiver: []quilkin.Filter{&quilkin.Compress{OnRead: "Decompress"}}})
+	timer = time.NewTimer(time.Second / 2)
+	select {
+	case <-updates:
+		t.Error("unchanged filters shouldn't be sent")
+	case <-timer.C:
+	}
+
+	store.RemoveReceiverProxy("game", "pod-1")
+	go store.SetFilters("game", ProxyFilters{})
+	timer = time.NewTimer(time.Second / 2)
+	select {
+	case <-updates:
+		t.Error("removed receiver proxies should not be updated")
+	case <-timer.C:
+	}
+}
+
+func TestSenderVariants(t *testing.T) {
+	t.Parallel()
+	updates := make(chan NodeConfig)
+	deletes := make(chan string)
+	store := NewSotWStore(updates, deletes, zap.L().Sugar())
+
+	id := SenderVariantID("game", "abc")
+	compress := &quilkin.Compress{OnRead: "Compress"}
+	go store.AddSenderVariant("game", id, VariantFilters{Filters: []quilkin.Filter{compress}}, "pod-1")
+	data := <-updates
+	if data.ProxyName != id || len(data.Filters) != 1 || len(data.Endpoints) != 0 {
+		t.Error("variant should be sent its own filters")
+	}
+
+	go store.AddReceiver("game", 7777, "10.0.0.2", "server-0")
+	seen := map[string]NodeConfig{}
+	for len(seen) < 2 {
+		data := <-updates
+		seen[data.ProxyName] = data
+	}
+	if variant := seen[id]; len(variant.Endpoints) != 1 || len(variant.Filters) != 1 {
+		t.Error("variant should be sent the endpoints of its proxy")
+	}
+
+	store.RemoveSenderVariant("game", "pod-1")
+	go store.RemoveReceiver("game", "server-0")
+	timer := time.NewTimer(time.Second / 2)
+	select {
+	case data := <-updates:
+		t.Errorf("removed variants should not be updated, got %s", data.ProxyName)
+	case <-timer.C:
+	}
+}
+
+func TestSenderVariantRateLimit(t *testing.T) {
+	t.Parallel()
+	updates := make(chan NodeConfig)
+	deletes := make(chan string)
+	store := NewSotWStore(updates, deletes, zap.L().Sugar())
+
+	compress := &quilkin.Compress{OnRead: "Compress"}
+	// Nothing uses the proxy yet so no update is sent
+	store.SetFilters("game", ProxyFilters{Sender: []quilkin.Filter{&quilkin.LocalRateLimit{MaxPackets: 1000}, compress}})
+	limit := &quilkin.LocalRateLimit{MaxPackets: 10}
+	id := SenderVariantID("game", "limited")
+	go store.AddSenderVariant("game", id, VariantFilters{RateLimit: limit}, "pod-1")
+	data := <-updates
+	if data.ProxyName != id || len(data.Filters) != 2 || data.Filters[0] != limit || data.Filters[1] != compress {
+		t.Errorf("the rate limit should replace the proxy's, got %v", data.Filters)
+	}
+
+	go store.SetFilters("game", ProxyFilters{Sender: []quilkin.Filter{compress}})
+	data = <-updates
+	if len(data.Filters) != 2 || data.Filters[0] != limit {
+		t.Errorf("the rate limit should be added first to the proxy's new chain, got %v", data.Filters)
+	}
+}
+
+func TestReceiverProxyFirewall(t *testing.T) {
+	t.Parallel()
+	updates := make(chan NodeConfig)
+	deletes := make(chan string)
+	store := NewSotWStore(updates, deletes, zap.L().Sugar())
+	receiverID := ReceiverProxyID("game", 7777)
+	// nextReceiver skips the updates of the sender proxy until the receiver side proxy is sent
+	nextReceiver := func() []string {
+		timer := time.NewTimer(time.Second / 2)
+		for {
+			select {
+			case data := <-updates:
+				if data.ProxyName != receiverID {
+					continue
+				}
+				firewall, ok := data.Filters[0].(*quilkin.Firewall)
+				if !ok {
+					t.Fatal("firewall should be the first receiver filter")
+				}
+				return firewall.Sources
+			case <-timer.C:
+				t.Fatal("Should return update")
+			}
+		}
+	}
+
+	go store.AddReceiverProxy("game", 7777, "server-0")
+	<-updates
+	go store.SetFilters("game", ProxyFilters{Firewall: &Firewall{CIDRs: []string{"192.168.0.0/16"}}})
+	if sources := nextReceiver(); len(sources) != 1 || sources[0] != "192.168.0.0/16" {
+		t.Errorf("unexpected sources %v", sources)
+	}
+
+	go store.AddSender("game", "client-0", "10.0.0.5")
+	if sources := nextReceiver(); len(sources) != 2 || sources[0] != "10.0.0.5/32" {
+		t.Errorf("senders should be allowed, got %v", sources)
+	}
+
+	go store.RemoveSender("game", "client-0")
+	if sources := nextReceiver(); len(sources) != 1 {
+		t.Errorf("removed senders should be dropped, got %v", sources)
+	}
+}
+
+func TestWatcherDoesNotBlock(t *testing.T) {
+	t.Parallel()
+	updates := make(chan NodeConfig, 16)
+	deletes := make(chan string)
+	store := NewSotWStore(updates, deletes, zap.L().Sugar())
+	watcher := store.Watch()
+
+	// Nobody takes the changes while the store is modified
+	for i := 0; i < 5; i++ {
+		store.AddReceiver("a", 1000+i, "10.0.0.1", "pod-1")
+		store.AddReceiver("b", 1000+i, "10.0.0.2", "pod-2")
+	}
+	select {
+	case <-watcher.Ready():
+	default:
+		t.Fatal("watcher should be signalled")
+	}
+	if changed := watcher.Take(); len(changed) != 2 {
+		t.Errorf("changes should be coalesced per proxy, got %v", changed)
+	}
+	if changed := watcher.Take(); len(changed) != 0 {
+		t.Errorf("taken changes should be cleared, got %v", changed)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import "github.com/nfowl/quilkin-controller/internal/quilkin"
+
+// SenderVariantPrefix is prepended to the xds node id of sender proxies with their own filter chain
+const SenderVariantPrefix = "variant/"
+
+// SenderVariantID returns the xds node id of the senders of a proxy sharing the filter chain identified by key
+func SenderVariantID(proxyName string, key string) string {
+	return SenderVariantPrefix + proxyName + "/" + key
+}
+
+// VariantFilters describes how the filter chain of a sender variant differs from the chain of its proxy
+type VariantFilters struct {
+	// Filters replaces the sender filters of the proxy unless nil
+	Filters []quilkin.Filter
+	// RateLimit replaces the LocalRateLimit filter of the chain, or is added first when it has none
+	RateLimit *quilkin.LocalRateLimit
+}
+
+// senderVariant tracks the sender pods of a proxy that change its filter chain the same way
+type senderVariant struct {
+	proxyName string
+	filters   VariantFilters
+	pods      map[string]struct{}
+}
+
+// AddSenderVariant records a sender pod of a proxy whose sidecar identifies itself with the variant id
+// provided. The variant is served the endpoints of the proxy with its filter chain changed as provided.
+func (s *SotwStore) AddSenderVariant(proxyName string, id string, filters VariantFilters, podName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	variant, ok := s.senderVariants[id]
+	if !ok {
+		variant = &senderVariant{proxyName: proxyName, pods: make(map[string]struct{})}
+		s.senderVariants[id] = variant
+	}
+	variant.filters = filters
+	variant.pods[podName] = struct{}{}
+	s.logger.Infow("Added sender variant", "id", id, "pod", podName)
+	s.nodeUpdates <- s.variantNode(id, variant)
+}
+
+// RemoveSenderVariant removes a sender pod from the variants of a proxy
+func (s *SotwStore) RemoveSenderVariant(proxyName string, podName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, variant := range s.senderVariants {
+		if variant.proxyName != proxyName {
+			continue
+		}
+		if _, ok := variant.pods[podName]; !ok {
+			continue
+		}
+		delete(variant.pods, podName)
+		s.logger.Infow("Removed sender variant", "id", id, "pod", podName)
+		if len(variant.pods) == 0 {
+			delete(s.senderVariants, id)
+		}
+	}
+}
+
+// updateSenderVariants sends a new config to every variant of the proxy provided.
+// Must be called with the lock held.
+func (s *SotwStore) updateSenderVariants(proxyName string) {
+	for id, variant := range s.senderVariants {
+		if variant.proxyName == proxyName {
+			s.nodeUpdates <- s.variantNode(id, variant)
+		}
+	}
+}
+
+// variantNode builds the config of a variant from the current endpoints of its proxy.
+// Must be called with the lock held.
+func (s *SotwStore) variantNode(id string, variant *senderVariant) NodeConfig {
+	endpoints := make(map[string]*Endpoint)
+	if node, ok := s.Nodes[variant.proxyName]; ok {
+		for key, endpoint := range node.Endpoints {
+			e := *endpoint
+			endpoints[key] = &e
+		}
+	}
+	return NodeConfig{
+		ProxyName: id,
+		Endpoints: endpoints,
+		Filters:   s.variantFilters(variant),
+		senders:   make(map[string]struct{}),
+	}
+}
+
+// variantFilters returns the filter chain of a variant. Must be called with the lock held.
+func (s *SotwStore) variantFilters(variant *senderVariant) []quilkin.Filter {
+	base := variant.filters.Filters
+	if base == nil {
+		base = s.filters[variant.proxyName].Sender
+	}
+	if variant.filters.RateLimit == nil {
+		return base
+	}
+	chain := make([]quilkin.Filter, 0, len(base)+1)
+	replaced := false
+	for _, filter := range base {
+		if _, ok := filter.(*quilkin.LocalRateLimit); ok && !replaced {
+			filter = variant.filters.RateLimit
+			replaced = true
+		}
+		chain = append(chain, filter)
+	}
+	if !replaced {
+		chain = append([]quilkin.Filter{variant.filters.RateLimit}, chain...)
+	}
+	return chain
+}
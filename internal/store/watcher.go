@@ -0,0 +1,59 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import "sync"
+
+// Watcher collects the names of proxies whose node changed or was removed. Changes are coalesced until
+// they are taken so a slow or stopped consumer never blocks the store.
+type Watcher struct {
+	mu      sync.Mutex
+	changed map[string]struct{}
+	signal  chan struct{}
+}
+
+func newWatcher() *Watcher {
+	return &Watcher{changed: make(map[string]struct{}), signal: make(chan struct{}, 1)}
+}
+
+// Ready returns a channel that receives a value whenever there are changes to take
+func (w *Watcher) Ready() <-chan struct{} {
+	return w.signal
+}
+
+// Take returns the proxies that changed since it was last called
+func (w *Watcher) Take() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	names := make([]string, 0, len(w.changed))
+	for name := range w.changed {
+		names = append(names, name)
+	}
+	w.changed = make(map[string]struct{})
+	return names
+}
+
+// add records a change to the proxy provided without blocking
+func (w *Watcher) add(proxyName string) {
+	w.mu.Lock()
+	w.changed[proxyName] = struct{}{}
+	w.mu.Unlock()
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
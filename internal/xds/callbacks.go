@@ -0,0 +1,111 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package xds
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/test/v3"
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/peer"
+)
+
+// snapshotInfo is the version and endpoint count of the latest snapshot of a node
+type snapshotInfo struct {
+	version   string
+	endpoints int
+}
+
+// AckCallbacks tracks which proxies have acknowledged a snapshot with at least one endpoint.
+// Proxies share node ids so they are told apart by the address of their stream, which is their pod IP.
+type AckCallbacks struct {
+	*test.Callbacks
+	mu        sync.Mutex
+	peers     map[int64]string
+	snapshots map[string]snapshotInfo
+	ready     chan<- store.ProxyAck
+	logger    *zap.SugaredLogger
+}
+
+// NewAckCallbacks returns callbacks sending the IP and node id of each proxy that acknowledges a snapshot
+// with endpoints to the channel provided. A nil channel disables tracking.
+func NewAckCallbacks(ready chan<- store.ProxyAck, l *zap.SugaredLogger) *AckCallbacks {
+	return &AckCallbacks{
+		Callbacks: &test.Callbacks{Debug: false},
+		peers:     make(map[int64]string),
+		snapshots: make(map[string]snapshotInfo),
+		ready:     ready,
+		logger:    l,
+	}
+}
+
+// setSnapshot records the latest snapshot served to a node
+func (cb *AckCallbacks) setSnapshot(nodeID string, version string, endpoints int) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.snapshots[nodeID] = snapshotInfo{version: version, endpoints: endpoints}
+}
+
+// OnStreamOpen records the address of the proxy that opened the stream
+func (cb *AckCallbacks) OnStreamOpen(ctx context.Context, id int64, typ string) error {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err == nil {
+			cb.mu.Lock()
+			cb.peers[id] = host
+			cb.mu.Unlock()
+		}
+	}
+	return cb.Callbacks.OnStreamOpen(ctx, id, typ)
+}
+
+// OnStreamClosed forgets the address of the stream
+func (cb *AckCallbacks) OnStreamClosed(id int64) {
+	cb.mu.Lock()
+	delete(cb.peers, id)
+	cb.mu.Unlock()
+	cb.Callbacks.OnStreamClosed(id)
+}
+
+// OnStreamRequest reports the proxy as ready when it acknowledges the latest cluster snapshot of its
+// node and that snapshot has endpoints
+func (cb *AckCallbacks) OnStreamRequest(id int64, req *discovery.DiscoveryRequest) error {
+	if cb.ready != nil && isAck(req) {
+		cb.mu.Lock()
+		info, ok := cb.snapshots[req.GetNode().GetId()]
+		ip := cb.peers[id]
+		cb.mu.Unlock()
+		if ok && ip != "" && info.version == req.VersionInfo && info.endpoints > 0 {
+			select {
+			case cb.ready <- store.ProxyAck{IP: ip, NodeID: req.GetNode().GetId()}:
+			default:
+				cb.logger.Warnw("Dropping proxy ready notification", "ip", ip, "node", req.GetNode().GetId())
+			}
+		}
+	}
+	return cb.Callbacks.OnStreamRequest(id, req)
+}
+
+// isAck returns whether the request acknowledges a cluster response without an error
+func isAck(req *discovery.DiscoveryRequest) bool {
+	return req.TypeUrl == resource.ClusterType && req.ResponseNonce != "" && req.ErrorDetail == nil
+}
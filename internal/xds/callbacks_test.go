@@ -0,0 +1,59 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package xds
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/nfowl/quilkin-controller/internal/store"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/peer"
+)
+
+func TestAckCallbacksReady(t *testing.T) {
+	ready := make(chan store.ProxyAck, 1)
+	cb := NewAckCallbacks(ready, zap.L().Sugar())
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 41000}})
+	if err := cb.OnStreamOpen(ctx, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	ack := func(version string) *discovery.DiscoveryRequest {
+		return &discovery.DiscoveryRequest{Node: &core.Node{Id: "game"}, TypeUrl: resource.ClusterType, VersionInfo: version, ResponseNonce: "1"}
+	}
+
+	cb.setSnapshot("game", "1", 0)
+	_ = cb.OnStreamRequest(1, ack("1"))
+	if len(ready) != 0 {
+		t.Error("snapshots without endpoints should not mark the proxy ready")
+	}
+
+	cb.setSnapshot("game", "2", 1)
+	_ = cb.OnStreamRequest(1, ack("1"))
+	if len(ready) != 0 {
+		t.Error("acks of stale versions should be ignored")
+	}
+	_ = cb.OnStreamRequest(1, ack("2"))
+	if ack := <-ready; ack.IP != "10.0.0.5" || ack.NodeID != "game" {
+		t.Errorf("unexpected ack %+v", ack)
+	}
+}
@@ -18,12 +18,14 @@ package xds
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 
 	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
@@ -40,6 +42,28 @@ const (
 	grpcMaxConcurrentStreams = 1000000
 )
 
+var (
+	// TLSCertFile is the certificate the xDS server serves TLS with. The server is plaintext when empty.
+	TLSCertFile string
+	// TLSKeyFile is the private key of TLSCertFile
+	TLSKeyFile string
+)
+
+// tlsConfig returns the TLS config of the xDS server. The certificate is read on every handshake, so rotated
+// certificates are picked up without a restart. Proxies hold a single long lived stream each.
+func tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(TLSCertFile, TLSKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		},
+	}
+}
+
 func registerServer(grpcServer *grpc.Server, server server.Server) {
 	// register services
 	discoverygrpc.RegisterAggregatedDiscoveryServiceServer(grpcServer, server)
@@ -66,6 +90,9 @@ func RunServer(ctx context.Context, srv server.Server, port uint) {
 			PermitWithoutStream: true,
 		}),
 	)
+	if TLSCertFile != "" {
+		grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(tlsConfig())))
+	}
 	grpcServer := grpc.NewServer(grpcOptions...)
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
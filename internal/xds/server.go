@@ -22,8 +22,8 @@ import (
 	"os"
 
 	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/server/v3"
-	"github.com/envoyproxy/go-control-plane/pkg/test/v3"
 	"github.com/nfowl/quilkin-controller/internal/store"
 	"go.uber.org/zap"
 )
@@ -43,10 +43,11 @@ func init() {
 }
 
 type CacheUpdater struct {
-	cache   cachev3.SnapshotCache
-	updates chan store.NodeConfig
-	deletes chan string
-	logger  *zap.SugaredLogger
+	cache     cachev3.SnapshotCache
+	updates   chan store.NodeConfig
+	deletes   chan string
+	callbacks *AckCallbacks
+	logger    *zap.SugaredLogger
 }
 
 func (c *CacheUpdater) handleUpdates() {
@@ -62,6 +63,7 @@ func (c *CacheUpdater) handleUpdates() {
 			c.logger.Error("snapshot error")
 			os.Exit(1)
 		}
+		c.callbacks.setSnapshot(update.ProxyName, snap.GetVersion(resource.ClusterType), len(update.Endpoints))
 	}
 }
 
@@ -73,12 +75,14 @@ func (c *CacheUpdater) handleDeletes() {
 	}
 }
 
-func StartServer(l *zap.SugaredLogger, updates chan store.NodeConfig, deletes chan string) {
+// StartServer runs the xDS server serving the node updates from the store. Proxies that acknowledge
+// a config with endpoints are sent to ready if it isn't nil.
+func StartServer(l *zap.SugaredLogger, updates chan store.NodeConfig, deletes chan string, ready chan<- store.ProxyAck) {
 	cache := cachev3.NewSnapshotCache(false, cachev3.IDHash{}, l)
-	updater := CacheUpdater{cache: cache, updates: updates, deletes: deletes, logger: l}
+	cb := NewAckCallbacks(ready, l)
+	updater := CacheUpdater{cache: cache, updates: updates, deletes: deletes, callbacks: cb, logger: l}
 	// Run the xDS server
 	ctx := context.Background()
-	cb := &test.Callbacks{Debug: false}
 	srv := server.NewServer(ctx, cache, cb)
 	go RunServer(ctx, srv, port)
 	go updater.handleDeletes()
@@ -22,9 +22,13 @@ import (
 	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/nfowl/quilkin-controller/internal/quilkin"
 	"github.com/nfowl/quilkin-controller/internal/store"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 const (
@@ -48,7 +52,11 @@ func makeCluster(clusterName string, node store.NodeConfig) *cluster.Cluster {
 func makeClusterLoadAssignment(clusterName string, node store.NodeConfig) *endpoint.ClusterLoadAssignment {
 	endpoints := make([]*endpoint.LbEndpoint, 0)
 	for _, receiver := range node.Endpoints {
-		endpoints = append(endpoints, &endpoint.LbEndpoint{HostIdentifier: &endpoint.LbEndpoint_Endpoint{Endpoint: makeEndpoint(receiver.Address, uint32(receiver.Port))}})
+		lbEndpoint := &endpoint.LbEndpoint{HostIdentifier: &endpoint.LbEndpoint_Endpoint{Endpoint: makeEndpoint(receiver.Address, uint32(receiver.Port))}}
+		if receiver.Weight > 0 {
+			lbEndpoint.LoadBalancingWeight = wrapperspb.UInt32(receiver.Weight)
+		}
+		endpoints = append(endpoints, lbEndpoint)
 	}
 	return &endpoint.ClusterLoadAssignment{
 		ClusterName: clusterName,
@@ -74,6 +82,23 @@ func makeEndpoint(host string, port uint32) *endpoint.Endpoint {
 	}
 }
 
+// makeListener builds the listener quilkin reads its filter chain from
+func makeListener(filters []quilkin.Filter) *listener.Listener {
+	chain := make([]*listener.Filter, 0, len(filters))
+	for _, filter := range filters {
+		chain = append(chain, &listener.Filter{
+			Name: filter.Name(),
+			ConfigType: &listener.Filter_TypedConfig{TypedConfig: &anypb.Any{
+				TypeUrl: "type.googleapis.com/" + filter.Name(),
+				Value:   filter.MarshalProto(),
+			}},
+		})
+	}
+	return &listener.Listener{
+		FilterChains: []*listener.FilterChain{{Filters: chain}},
+	}
+}
+
 func generateNodeSnapshot(node store.NodeConfig) cache.Snapshot {
 	val, ok := nodeVersions[node.ProxyName]
 	if !ok {
@@ -86,7 +111,7 @@ func generateNodeSnapshot(node store.NodeConfig) cache.Snapshot {
 		[]types.Resource{}, // endpoints
 		clusterResources,
 		[]types.Resource{}, // routes
-		[]types.Resource{}, // listeners
+		[]types.Resource{makeListener(node.Filters)},
 		[]types.Resource{}, // runtimes
 		[]types.Resource{}, // secrets
 	)
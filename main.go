@@ -17,16 +17,22 @@ limitations under the License.
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 
 	//+kubebuilder:scaffold:imports
 
+	quilkinv1alpha1 "github.com/nfowl/quilkin-controller/api/v1alpha1"
 	"github.com/nfowl/quilkin-controller/internal/controller"
+	"github.com/nfowl/quilkin-controller/internal/gatewayapi"
+	"github.com/nfowl/quilkin-controller/internal/quilkin"
 	"github.com/nfowl/quilkin-controller/internal/store"
 	"github.com/nfowl/quilkin-controller/internal/xds"
 	corev1 "k8s.io/api/core/v1"
@@ -46,10 +52,14 @@ const controllerName = "quilkin-controller"
 var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("setup")
+	// version is set by goreleaser at build time
+	version = "dev"
 )
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(quilkinv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(gatewayapi.AddToScheme(scheme))
 
 	//+kubebuilder:scaffold:scheme
 }
@@ -60,10 +70,52 @@ func main() {
 	var probeAddr string
 	var certDir string
 	var quilkinImage string
+	var publishEndpoints bool
+	var publishService bool
+	var publishNamespace string
+	var enableGatewayAPI bool
+	var proxyMode string
+	var nodeProxyDaemonSet bool
+	var nodeProxyNamespace string
+	var nodeProxyPorts string
+	var nativeSidecars bool
+	var readinessGate bool
+	var rolloutPeriod time.Duration
+	var rolloutRestart bool
+	var managementServer quilkin.ManagementServerOptions
+	var managementServerAddresses string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.StringVar(&certDir, "cert-dir", "/cert", "The folder the certs are located in")
 	flag.StringVar(&quilkinImage, "quilkin-image", "us-docker.pkg.dev/quilkin/release/quilkin:0.1.0", "The image to use as the injected image")
+	flag.StringVar(&controller.QuilkinVersion, "quilkin-version", "", "The quilkin version of the injected image. Read from the image tag when empty.")
+	flag.StringVar(&managementServer.Service, "management-server-service", "", "The name of the Service proxies reach the xDS server through")
+	flag.StringVar(&managementServer.Namespace, "management-server-namespace", "", "The namespace of the management server Service")
+	flag.StringVar(&managementServer.ClusterDomain, "cluster-domain", "cluster.local", "The DNS domain of the cluster")
+	flag.IntVar(&managementServer.Port, "management-server-port", 18000, "The xDS port of the management server Service")
+	flag.StringVar(&managementServer.Scheme, "management-server-scheme", "http", "The scheme proxies connect to the management server Service with. Either http or https, which requires --xds-tls-cert-file.")
+	flag.StringVar(&xds.TLSCertFile, "xds-tls-cert-file", "", "The certificate the xDS server serves TLS with. Plaintext is served when empty.")
+	flag.StringVar(&xds.TLSKeyFile, "xds-tls-key-file", "", "The private key of --xds-tls-cert-file")
+	flag.StringVar(&managementServerAddresses, "management-server-addresses", "", "Comma separated management server URLs used instead of the Service, e.g. http://10.0.0.1:18000")
+	flag.BoolVar(&publishEndpoints, "publish-endpoints", false, "Publish the receivers of every proxy as EndpointSlices")
+	flag.BoolVar(&publishService, "publish-service", false, "Create a headless Service per proxy owning the published EndpointSlices")
+	flag.StringVar(&publishNamespace, "publish-namespace", os.Getenv("POD_NAMESPACE"), "The namespace published EndpointSlices are created in")
+	flag.StringVar(&proxyMode, "proxy-mode", controller.SidecarProxyMode, "How senders reach their proxy. Either sidecar or node.")
+	flag.BoolVar(&nodeProxyDaemonSet, "node-proxy-daemonset", false, "Create the quilkin DaemonSet used in node proxy mode")
+	flag.StringVar(&nodeProxyNamespace, "node-proxy-namespace", os.Getenv("POD_NAMESPACE"), "The namespace the node proxy DaemonSet is created in")
+	flag.StringVar(&nodeProxyPorts, "node-proxy-ports", "", "Comma separated proxy=port pairs giving the host port of the node proxy of each proxy senders use in node proxy mode, e.g. game=7000,chat=7001")
+	flag.StringVar(&controller.NodeProxyInitImage, "node-proxy-init-image", controller.NodeProxyInitImage, "The image used to render the node proxy config")
+	flag.StringVar(&controller.DefaultSidecarTemplate, "sidecar-template", "", "The namespace/name of a ConfigMap holding the template applied to injected quilkin containers")
+	flag.BoolVar(&nativeSidecars, "native-sidecars", false, "Inject quilkin as a native sidecar init container when the API server supports it")
+	flag.BoolVar(&readinessGate, "readiness-gate", false, "Gate sender pod readiness on their sidecar receiving endpoints")
+	flag.StringVar(&controller.CaptureImage, "capture-image", controller.CaptureImage, "The image of the init container redirecting captured traffic. Must provide iptables.")
+	flag.IntVar(&controller.DefaultProxyPort, "proxy-port", controller.DefaultProxyPort, "The port sender sidecars listen on unless set by namespace or pod annotations")
+	flag.IntVar(&controller.DefaultAdminPort, "admin-port", controller.DefaultAdminPort, "The admin port of sender sidecars unless set by namespace or pod annotations")
+	flag.StringVar(&controller.DefaultPortConflict, "port-conflict", controller.PortConflictReject, "What happens when a container of a sender declares a port of its sidecar unless set by namespace or pod annotations. Either reject or auto.")
+	flag.DurationVar(&controller.DefaultDrainPeriod, "drain-period", 0, "How long terminating receivers keep being served to senders unless set by namespace or pod annotations")
+	flag.DurationVar(&rolloutPeriod, "rollout-check-period", time.Minute, "How often injected pods are checked for outdated quilkin containers")
+	flag.BoolVar(&rolloutRestart, "rollout-restart", false, "Restart the Deployments and StatefulSets owning outdated injected pods, one per check period")
+	flag.BoolVar(&enableGatewayAPI, "gateway-api", false, "Act as a Gateway API implementation for UDPRoutes. Requires the Gateway API CRDs to be installed.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -74,6 +126,54 @@ func main() {
 	flag.Parse()
 
 	controller.QuilkinImage = quilkinImage
+	if (xds.TLSCertFile == "") != (xds.TLSKeyFile == "") {
+		fmt.Fprintln(os.Stderr, "--xds-tls-cert-file and --xds-tls-key-file must be set together")
+		os.Exit(1)
+	}
+	managementServer.TLS = xds.TLSCertFile != ""
+	if managementServer.TLS {
+		if _, err := tls.LoadX509KeyPair(xds.TLSCertFile, xds.TLSKeyFile); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid xDS TLS certificate: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if managementServerAddresses != "" {
+		managementServer.Addresses = strings.Split(managementServerAddresses, ",")
+	}
+	managementServers, err := managementServer.URLs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid management server options: %v\n", err)
+		os.Exit(1)
+	}
+	quilkin.SetManagementServers(managementServers)
+	controller.Version = version
+	if _, err := controller.DefaultQuilkinVersion(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --quilkin-image or --quilkin-version: %v\n", err)
+		os.Exit(1)
+	}
+	if proxyMode != controller.SidecarProxyMode && proxyMode != controller.NodeProxyMode {
+		fmt.Fprintf(os.Stderr, "invalid --proxy-mode %q\n", proxyMode)
+		os.Exit(1)
+	}
+	controller.ProxyMode = proxyMode
+	controller.NodeProxyPorts, err = controller.ParseNodeProxyPorts(nodeProxyPorts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --node-proxy-ports: %v\n", err)
+		os.Exit(1)
+	}
+	if proxyMode == controller.NodeProxyMode && len(controller.NodeProxyPorts) == 0 {
+		fmt.Fprintf(os.Stderr, "--node-proxy-ports is required with --proxy-mode %s\n", controller.NodeProxyMode)
+		os.Exit(1)
+	}
+	if controller.DefaultProxyPort < 1 || controller.DefaultProxyPort > 65535 || controller.DefaultAdminPort < 1 ||
+		controller.DefaultAdminPort > 65535 || controller.DefaultProxyPort == controller.DefaultAdminPort {
+		fmt.Fprintf(os.Stderr, "invalid --proxy-port %d and --admin-port %d\n", controller.DefaultProxyPort, controller.DefaultAdminPort)
+		os.Exit(1)
+	}
+	if controller.DefaultPortConflict != controller.PortConflictReject && controller.DefaultPortConflict != controller.PortConflictAuto {
+		fmt.Fprintf(os.Stderr, "invalid --port-conflict %q\n", controller.DefaultPortConflict)
+		os.Exit(1)
+	}
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
@@ -91,6 +191,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	if nativeSidecars {
+		supported, err := controller.SupportsNativeSidecars(mgr.GetConfig())
+		if err != nil {
+			setupLog.Error(err, "unable to detect native sidecar support, injecting regular containers")
+		} else if !supported {
+			setupLog.Info("API server does not support native sidecars, injecting regular containers")
+		}
+		controller.NativeSidecars = supported
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -109,11 +219,66 @@ func main() {
 		setupLog.Error(err, "Failed to add reconciler")
 		os.Exit(1)
 	}
+	if err = controller.NewConfigMapReconciler(mgr.GetClient(), zap.NewRaw().Sugar()).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "Failed to add config map reconciler")
+		os.Exit(1)
+	}
+	if err = controller.NewServiceReceiverReconciler(mgr.GetClient(), zap.NewRaw().Sugar(), inMemoryStore).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "Failed to add service receiver reconciler")
+		os.Exit(1)
+	}
+	if err = controller.NewExternalReceiverReconciler(mgr.GetClient(), zap.NewRaw().Sugar(), inMemoryStore).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "Failed to add external receiver reconciler")
+		os.Exit(1)
+	}
+	if err = controller.NewProxyReconciler(mgr.GetClient(), zap.NewRaw().Sugar(), inMemoryStore).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "Failed to add proxy reconciler")
+		os.Exit(1)
+	}
+	if err = mgr.Add(controller.NewRolloutChecker(mgr.GetClient(), zap.NewRaw().Sugar(), rolloutPeriod, rolloutRestart)); err != nil {
+		setupLog.Error(err, "Failed to add rollout checker")
+		os.Exit(1)
+	}
+	if publishEndpoints {
+		if err = controller.NewEndpointPublisher(mgr.GetClient(), zap.NewRaw().Sugar(), inMemoryStore, publishNamespace, publishService).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Failed to add endpoint publisher")
+			os.Exit(1)
+		}
+	}
+	if proxyMode == controller.NodeProxyMode && nodeProxyDaemonSet {
+		if err = controller.NewNodeProxyReconciler(mgr.GetClient(), zap.NewRaw().Sugar(), nodeProxyNamespace).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Failed to add node proxy reconciler")
+			os.Exit(1)
+		}
+	}
+	if enableGatewayAPI {
+		if err = controller.NewGatewayClassReconciler(mgr.GetClient(), zap.NewRaw().Sugar()).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Failed to add gateway class reconciler")
+			os.Exit(1)
+		}
+		if err = controller.NewGatewayReconciler(mgr.GetClient(), zap.NewRaw().Sugar()).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Failed to add gateway reconciler")
+			os.Exit(1)
+		}
+		if err = controller.NewUDPRouteReconciler(mgr.GetClient(), zap.NewRaw().Sugar(), inMemoryStore).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Failed to add udp route reconciler")
+			os.Exit(1)
+		}
+	}
+	var ready chan store.ProxyAck
+	if readinessGate {
+		controller.ReadinessGate = true
+		ready = make(chan store.ProxyAck, 1024)
+		if err = controller.NewReadinessGateSetter(mgr.GetClient(), zap.NewRaw().Sugar(), ready).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Failed to add readiness gate setter")
+			os.Exit(1)
+		}
+	}
 	mgr.GetWebhookServer().Register("/mutate-v1-pod", &webhook.Admission{Handler: controller.NewQuilkinAnnotationReader(mgr.GetClient(), zap.NewRaw().Sugar(), inMemoryStore)})
 
 	setupLog.Info("Starting XDS")
 
-	xds.StartServer(zap.NewRaw().Sugar(), updates, deletes)
+	xds.StartServer(zap.NewRaw().Sugar(), updates, deletes, ready)
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {